@@ -7,6 +7,7 @@ import (
 	"os/user"
 	"path/filepath"
 	"regexp"
+	"strings"
 	"text/tabwriter"
 	"time"
 
@@ -16,11 +17,12 @@ import (
 	"github.com/DTreshy/sup/internal/network"
 	"github.com/DTreshy/sup/internal/sup"
 	"github.com/DTreshy/sup/internal/supfile"
-	"github.com/mikkeloscar/sshconfig"
+	"github.com/DTreshy/sup/pkg/colors"
+	"github.com/DTreshy/sup/pkg/sshconfig"
 )
 
 var (
-	ErrUsage            = errors.New("Usage: sup [OPTIONS] NETWORK COMMAND [...]\n       sup [ --help | -v | --version ]")
+	ErrUsage            = errors.New("Usage: sup [OPTIONS] NETWORK COMMAND [...]\n       sup [OPTIONS] shell NETWORK\n       sup [ --help | -v | --version ]")
 	ErrUnknownNetwork   = errors.New("Unknown network")
 	ErrNetworkNoHosts   = errors.New("No hosts defined for a given network")
 	ErrCmd              = errors.New("Unknown command/target")
@@ -64,18 +66,78 @@ func parseArgs(conf *supfile.Supfile) (*network.Network, []*command.Command, err
 		return nil, nil, ErrUsage
 	}
 
+	net, err := parseNetwork(conf, args[0])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Check for the second argument
+	if len(args) < 2 {
+		conf.CmdUsage()
+		return nil, nil, ErrUsage
+	}
+
+	for _, name := range args[1:] {
+		// Target?
+		target, isTarget := conf.Targets.Get(name)
+		if isTarget {
+			// Loop over target's commands.
+			for _, cmdName := range target {
+				cmd, isCommand := conf.Commands.Get(cmdName)
+				if !isCommand {
+					conf.CmdUsage()
+					return nil, nil, fmt.Errorf("%v: %v", ErrCmd, cmdName)
+				}
+
+				cmd.Name = cmdName
+				commands = append(commands, &cmd)
+			}
+		}
+
+		// Command?
+		cmd, isCommand := conf.Commands.Get(name)
+		if isCommand {
+			cmd.Name = name
+			commands = append(commands, &cmd)
+		}
+
+		if !isTarget && !isCommand {
+			conf.CmdUsage()
+			return nil, nil, fmt.Errorf("%v: %v", ErrCmd, name)
+		}
+	}
+
+	return net, commands, nil
+}
+
+// shellArgs reports whether the args are "shell NETWORK", ie. the shell
+// mode. A network called "shell" takes precedence.
+func shellArgs(conf *supfile.Supfile) bool {
+	args := flags.Args()
+	if len(args) != 2 || args[0] != "shell" {
+		return false
+	}
+
+	_, isNetwork := conf.Networks.Get(args[0])
+
+	return !isNetwork
+}
+
+// parseNetwork returns the network of the given name, with its inventory
+// hosts and the default env variables set.
+func parseNetwork(conf *supfile.Supfile, name string) (*network.Network, error) {
 	// Does the <network> exist?
-	net, ok := conf.Networks.Get(args[0])
+	net, ok := conf.Networks.Get(name)
 	if !ok {
 		networkUsage(conf)
-		return nil, nil, ErrUnknownNetwork
+		return nil, ErrUnknownNetwork
 	}
 
 	net.SetEnvs(flag.EnvVars)
 
 	hosts, err := net.ParseInventory()
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
 	net.Hosts = append(net.Hosts, hosts...)
@@ -83,13 +145,7 @@ func parseArgs(conf *supfile.Supfile) (*network.Network, []*command.Command, err
 	// Does the <network> have at least one host?
 	if len(net.Hosts) == 0 {
 		networkUsage(conf)
-		return nil, nil, ErrNetworkNoHosts
-	}
-
-	// Check for the second argument
-	if len(args) < 2 {
-		conf.CmdUsage()
-		return nil, nil, ErrUsage
+		return nil, ErrNetworkNoHosts
 	}
 
 	// In case of the network.Env needs an initialization
@@ -98,7 +154,7 @@ func parseArgs(conf *supfile.Supfile) (*network.Network, []*command.Command, err
 	}
 
 	// Add default env variable with current network
-	net.Env.Set("SUP_NETWORK", args[0])
+	net.Env.Set("SUP_NETWORK", name)
 	// Add default nonce
 	net.Env.Set("SUP_TIME", time.Now().UTC().Format(time.RFC3339))
 
@@ -113,37 +169,36 @@ func parseArgs(conf *supfile.Supfile) (*network.Network, []*command.Command, err
 		net.Env.Set("SUP_USER", os.Getenv("USER"))
 	}
 
-	for _, name := range args[1:] {
-		// Target?
-		target, isTarget := conf.Targets.Get(name)
-		if isTarget {
-			// Loop over target's commands.
-			for _, cmdName := range target {
-				cmd, isCommand := conf.Commands.Get(cmdName)
-				if !isCommand {
-					conf.CmdUsage()
-					return nil, nil, fmt.Errorf("%v: %v", ErrCmd, cmdName)
-				}
+	return &net, nil
+}
 
-				cmd.Name = cmdName
-				commands = append(commands, &cmd)
-			}
-		}
+// matchHost reports whether the host or its alias matches the regexp.
+func matchHost(expr *regexp.Regexp, host network.Host) bool {
+	return expr.MatchString(host.String()) || (host.Name != "" && expr.MatchString(host.Name))
+}
 
-		// Command?
-		cmd, isCommand := conf.Commands.Get(name)
-		if isCommand {
-			cmd.Name = name
-			commands = append(commands, &cmd)
-		}
+// loadSSHConfig reads the ssh_config file. Missing ~/.ssh/config is not
+// an error, "none" disables ssh_config.
+func loadSSHConfig(file string) (*sshconfig.Config, error) {
+	if file == "none" {
+		return nil, nil
+	}
 
-		if !isTarget && !isCommand {
-			conf.CmdUsage()
-			return nil, nil, fmt.Errorf("%v: %v", ErrCmd, name)
+	if file == "" {
+		conf, err := sshconfig.Load(resolvePath("~/.ssh/config"))
+		if os.IsNotExist(err) {
+			return nil, nil
 		}
+
+		return conf, err
+	}
+
+	conf, err := sshconfig.Load(resolvePath(file))
+	if err != nil {
+		return nil, errors.Join(err, ErrConfigFile)
 	}
 
-	return &net, commands, nil
+	return conf, nil
 }
 
 func resolvePath(path string) string {
@@ -151,7 +206,7 @@ func resolvePath(path string) string {
 		return ""
 	}
 
-	if path[:2] == "~/" {
+	if strings.HasPrefix(path, "~/") {
 		usr, err := user.Current()
 		if err == nil {
 			path = filepath.Join(usr.HomeDir, path[2:])
@@ -162,6 +217,21 @@ func resolvePath(path string) string {
 }
 
 func main() {
+	// Background connection master, started by sup itself.
+	if len(os.Args) == 4 && os.Args[1] == sup.MuxServeArg {
+		persist, err := time.ParseDuration(os.Args[3])
+		if err == nil {
+			err = sup.ServeMux(os.Args[2], persist)
+		}
+
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+
+		return
+	}
+
 	flag = flags.New()
 
 	if flag.ShowHelp {
@@ -199,7 +269,18 @@ func main() {
 	}
 
 	// Parse network and commands to be run from args.
-	net, commands, err := parseArgs(conf)
+	var (
+		net      *network.Network
+		commands []*command.Command
+		shell    = shellArgs(conf)
+	)
+
+	if shell {
+		net, err = parseNetwork(conf, flags.Args()[1])
+	} else {
+		net, commands, err = parseArgs(conf)
+	}
+
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
@@ -213,10 +294,10 @@ func main() {
 			os.Exit(1)
 		}
 
-		var hosts []string
+		var hosts []network.Host
 
 		for _, host := range net.Hosts {
-			if expr.MatchString(host) {
+			if matchHost(expr, host) {
 				hosts = append(hosts, host)
 			}
 		}
@@ -237,10 +318,10 @@ func main() {
 			os.Exit(1)
 		}
 
-		var hosts []string
+		var hosts []network.Host
 
 		for _, host := range net.Hosts {
-			if !expr.MatchString(host) {
+			if !matchHost(expr, host) {
 				hosts = append(hosts, host)
 			}
 		}
@@ -253,32 +334,83 @@ func main() {
 		net.Hosts = hosts
 	}
 
-	// --sshconfig flag location for ssh_config file
-	if flag.SshConfig != "" {
-		confHosts, err := sshconfig.ParseSSHConfig(resolvePath(flag.SshConfig))
+	// --tags flag filters hosts by their tags
+	if flag.Tags != "" {
+		selector, err := network.ParseSelector(flag.Tags)
 		if err != nil {
 			fmt.Fprintln(os.Stderr, err)
 			os.Exit(1)
 		}
 
-		// flatten Host -> *SSHHost, not the prettiest
-		// but will do
-		confMap := map[string]*sshconfig.SSHHost{}
+		var hosts []network.Host
 
-		for _, conf := range confHosts {
-			for _, host := range conf.Host {
-				confMap[host] = conf
+		for _, host := range net.Hosts {
+			if selector.Matches(host) {
+				hosts = append(hosts, host)
 			}
 		}
 
-		// check network.Hosts for match
-		for _, host := range net.Hosts {
-			conf, found := confMap[host]
-			if found {
-				net.User = conf.User
-				net.IdentityFile = resolvePath(conf.IdentityFile)
-				net.Hosts = []string{fmt.Sprintf("%s:%d", conf.HostName, conf.Port)}
-			}
+		if len(hosts) == 0 {
+			fmt.Fprintln(os.Stderr, fmt.Errorf("no hosts match --tags '%v' selector", flag.Tags))
+			os.Exit(1)
+		}
+
+		net.Hosts = hosts
+	}
+
+	// --host-key-check flag overrides the network's host key checking mode
+	if flag.HostKeyCheck != "" {
+		net.HostKeyCheck = flag.HostKeyCheck
+	}
+
+	// --control-persist and --control-path flags override the network's connection multiplexing
+	if flag.ControlPersist != 0 {
+		net.ControlPersist = flag.ControlPersist
+	}
+
+	if flag.ControlPath != "" {
+		net.ControlPath = flag.ControlPath
+	}
+
+	// Connection timeout, retry and keepalive flags override the network's ones
+	if flag.ConnectTimeout != 0 {
+		net.ConnectTimeout = flag.ConnectTimeout
+	}
+
+	if flag.ConnectRetries >= 0 {
+		net.ConnectRetries = flag.ConnectRetries
+	}
+
+	if flag.RetryBackoff != 0 {
+		net.RetryBackoff = flag.RetryBackoff
+	}
+
+	if flag.ServerAliveInterval != 0 {
+		net.ServerAliveInterval = flag.ServerAliveInterval
+	}
+
+	if flag.ServerAliveCountMax != 0 {
+		net.ServerAliveCountMax = flag.ServerAliveCountMax
+	}
+
+	// --parallel flag overrides the network's max_parallel
+	if flag.Parallel > 0 {
+		net.MaxParallel = flag.Parallel
+	}
+
+	net.ControlPath = resolvePath(net.ControlPath)
+	net.KnownHosts = resolvePath(net.KnownHosts)
+	net.IdentityFile = resolvePath(net.IdentityFile)
+
+	for i := range net.Bastion {
+		net.Bastion[i].IdentityFile = resolvePath(net.Bastion[i].IdentityFile)
+	}
+
+	for i := range net.Hosts {
+		net.Hosts[i].IdentityFile = resolvePath(net.Hosts[i].IdentityFile)
+
+		for j := range net.Hosts[i].Bastion {
+			net.Hosts[i].Bastion[j].IdentityFile = resolvePath(net.Hosts[i].Bastion[j].IdentityFile)
 		}
 	}
 
@@ -293,6 +425,13 @@ func main() {
 		os.Exit(1)
 	}
 
+	for i := range net.Hosts {
+		if err := net.Hosts[i].Env.ResolveValuesWith(vars); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
 	// Create new Stackup app.
 	app, err := sup.New(conf)
 	if err != nil {
@@ -300,13 +439,91 @@ func main() {
 		os.Exit(1)
 	}
 
+	// --sshconfig flag location for ssh_config file, ~/.ssh/config by default
+	sshConfig, err := loadSSHConfig(flag.SshConfig)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	app.SSHConfig(sshConfig)
 	app.Debug(flag.Debug)
 	app.Prefix(!flag.DisablePrefix)
 
-	// Run all the commands in the given network.
-	err = app.Run(net, vars, commands...)
+	// --prefix-format flag overrides the Supfile's prefix template
+	prefixFormat := conf.Prefix
+	if flag.PrefixFormat != "" {
+		prefixFormat = flag.PrefixFormat
+	}
+
+	if err := app.PrefixFormat(prefixFormat); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	// No colors in the files and pipes, or if NO_COLOR is set
+	if !colors.Supported(os.Stdout) {
+		colors.Disable()
+	}
+
+	app.Timeout(flag.Timeout)
+
+	// --aggregate flag is a shortcut of --output aggregate
+	if flag.Aggregate {
+		if flag.Output != sup.OutputText && flag.Output != sup.OutputAggregate {
+			fmt.Fprintf(os.Stderr, "--aggregate can't be combined with --output %v\n", flag.Output)
+			os.Exit(1)
+		}
+
+		flag.Output = sup.OutputAggregate
+	}
+
+	if err := app.Normalize(flag.Normalize); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	// --output flag selects text, JSON events, grouped or aggregate output
+	if err := app.Output(flag.Output); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	// --log-dir flag writes the output to per host and command log files
+	app.LogDir(resolvePath(flag.LogDir))
+
+	// "shell NETWORK" runs the lines read from STDIN on all the hosts
+	if shell {
+		if flag.LogDir != "" {
+			fmt.Fprintln(os.Stderr, "--log-dir can't be used in the shell mode")
+			os.Exit(1)
+		}
+
+		if err := app.Shell(net, vars, os.Stdin, os.Stderr); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+
+		return
+	}
+
+	// --dry-run flag prints the plan instead of running the commands
+	if flag.DryRun {
+		if err := app.Plan(os.Stdout, net, vars, commands...); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+
+		return
+	}
+
+	// Run all the commands in the given network. The summary is printed
+	// by the output.
+	report, err := app.Run(net, vars, commands...)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
+
+	os.Exit(report.ExitStatus())
 }
@@ -3,16 +3,14 @@ module github.com/DTreshy/sup
 go 1.20
 
 require (
-	github.com/goware/prefixer v0.0.0-20160118172347-395022866408
-	github.com/mikkeloscar/sshconfig v0.1.1
+	github.com/pmezard/go-difflib v1.0.0
 	github.com/stretchr/testify v1.8.4
 	golang.org/x/crypto v0.17.0
+	golang.org/x/term v0.15.0
 	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
-	github.com/mitchellh/go-homedir v1.1.0 // indirect
-	github.com/pmezard/go-difflib v1.0.0 // indirect
 	golang.org/x/sys v0.15.0 // indirect
 )
@@ -2,26 +2,76 @@ package command
 
 import (
 	"fmt"
+	"time"
 
+	"github.com/DTreshy/sup/internal/network"
 	"github.com/DTreshy/sup/pkg/unmarshaller"
 )
 
 // Command represents command(s) to be run remotely.
 type Command struct {
-	Name   string   `yaml:"-"`      // Command name.
-	Desc   string   `yaml:"desc"`   // Command description.
-	Local  string   `yaml:"local"`  // Command(s) to be run locally.
-	Run    string   `yaml:"run"`    // Command(s) to be run remotely.
-	Script string   `yaml:"script"` // Load command(s) from script and run it remotely.
-	Upload []Upload `yaml:"upload"` // See Upload struct.
-	Stdin  bool     `yaml:"stdin"`  // Attach localhost STDOUT to remote commands' STDIN?
-	Once   bool     `yaml:"once"`   // The command should be run "once" (on one host only).
-	Serial int      `yaml:"serial"` // Max number of clients processing a task in parallel.
+	Name     string     `yaml:"-"`        // Command name.
+	Desc     string     `yaml:"desc"`     // Command description.
+	Local    string     `yaml:"local"`    // Command(s) to be run locally.
+	Run      string     `yaml:"run"`      // Command(s) to be run remotely.
+	Script   string     `yaml:"script"`   // Load command(s) from script and run it remotely.
+	Upload   []Upload   `yaml:"upload"`   // See Upload struct.
+	Download []Download `yaml:"download"` // See Download struct.
+	Stdin    bool       `yaml:"stdin"`    // Attach localhost STDOUT to remote commands' STDIN?
+	Once     bool       `yaml:"once"`     // The command should be run "once" (on one host only).
+	Serial   int        `yaml:"serial"`   // Max number of clients processing a task in parallel.
+
+	ForwardAgent bool             `yaml:"forward_agent"` // Forward the local ssh-agent to the remote commands.
+	Tunnels      []network.Tunnel `yaml:"tunnels"`       // Port forwardings open while the command runs.
+	Timeout      time.Duration    `yaml:"timeout"`       // Time limit of each task of the command, ie. 5m.
+	TTY          *bool            `yaml:"tty"`           // Run remote commands in a pseudo terminal, true by default.
+	Stream       bool             `yaml:"stream"`        // Print the output live, even in the grouped output mode.
+
+	IgnoreErrors   bool `yaml:"ignore_errors"`    // Failures don't stop the run, nor drop the hosts.
+	MaxFail        int  `yaml:"max_fail"`         // Max number of hosts allowed to fail.
+	MaxFailPercent int  `yaml:"max_fail_percent"` // Max percentage of hosts allowed to fail.
 
 	// API backward compatibility. Will be deprecated in v1.0.
 	RunOnce bool `yaml:"run_once"` // The command should be run once only.
 }
 
+// IsRemote reports whether the command runs anything on the network hosts.
+func (c *Command) IsRemote() bool {
+	return c.Run != "" || c.Script != "" || len(c.Upload) > 0 || len(c.Download) > 0
+}
+
+// UseTTY reports whether the remote commands run in a pseudo terminal.
+// Without it, their STDOUT and STDERR are kept separate.
+func (c *Command) UseTTY() bool {
+	return c.TTY == nil || *c.TTY
+}
+
+// MaxFailures returns the number of hosts, out of the given number of hosts
+// running the command, that may fail without stopping the whole run.
+// If both max_fail and max_fail_percent are set, the lower limit applies.
+func (c *Command) MaxFailures(hosts int) int {
+	if c.IgnoreErrors {
+		return hosts
+	}
+
+	allowed := -1
+	if c.MaxFail > 0 {
+		allowed = c.MaxFail
+	}
+
+	if c.MaxFailPercent > 0 {
+		if percent := hosts * c.MaxFailPercent / 100; allowed < 0 || percent < allowed {
+			allowed = percent
+		}
+	}
+
+	if allowed < 0 {
+		return 0
+	}
+
+	return allowed
+}
+
 // Upload represents file copy operation from localhost Src path to Dst
 // path of every host in a given Network.
 type Upload struct {
@@ -30,6 +80,14 @@ type Upload struct {
 	Exc string `yaml:"exclude"`
 }
 
+// Download represents file copy operation from Src path of every host
+// in a given Network to localhost Dst directory. Each host's files are
+// stored in a separate Dst/<host> subdirectory.
+type Download struct {
+	Src string `yaml:"src"`
+	Dst string `yaml:"dst"`
+}
+
 // Commands is a list of user-defined commands
 type Commands struct {
 	Names []string
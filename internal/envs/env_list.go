@@ -38,6 +38,17 @@ func (e *EnvList) UnmarshalYAML(unmarshal func(any) error) error {
 	return nil
 }
 
+// Get returns value of the environment variable, if set.
+func (e EnvList) Get(key string) (string, bool) {
+	for _, env := range e {
+		if env.Key == key {
+			return env.Value, true
+		}
+	}
+
+	return "", false
+}
+
 // Set key to be equal value in this list.
 func (e *EnvList) Set(key, value string) {
 	for i, v := range *e {
@@ -54,12 +65,20 @@ func (e *EnvList) Set(key, value string) {
 }
 
 func (e *EnvList) ResolveValues() error {
+	return e.resolveValues("")
+}
+
+// ResolveValuesWith resolves the values in context of the base env vars,
+// so that the values may reference them.
+func (e *EnvList) ResolveValuesWith(base EnvList) error {
+	return e.resolveValues(base.AsExport())
+}
+
+func (e *EnvList) resolveValues(exports string) error {
 	if len(*e) == 0 {
 		return nil
 	}
 
-	exports := ""
-
 	for i, v := range *e {
 		exports += v.AsExport()
 
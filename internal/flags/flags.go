@@ -2,16 +2,36 @@ package flags
 
 import (
 	"flag"
+	"time"
 )
 
 type Flags struct {
-	File          string
-	EnvVars       FlagStringSlice
-	SshConfig     string
-	OnlyHosts     string
-	ExceptHosts   string
+	File           string
+	EnvVars        FlagStringSlice
+	SshConfig      string
+	OnlyHosts      string
+	ExceptHosts    string
+	Tags           string
+	HostKeyCheck   string
+	ControlPath    string
+	ControlPersist time.Duration
+	Timeout        time.Duration
+	Output         string
+	LogDir         string
+	Aggregate      bool
+	Normalize      FlagStringSlice
+	PrefixFormat   string
+
+	ConnectTimeout      time.Duration
+	ConnectRetries      int
+	RetryBackoff        time.Duration
+	ServerAliveInterval time.Duration
+	ServerAliveCountMax int
+	Parallel            int
+
 	Debug         bool
 	DisablePrefix bool
+	DryRun        bool
 	ShowVersion   bool
 	ShowHelp      bool
 }
@@ -25,9 +45,27 @@ func New() *Flags {
 	flag.StringVar(&f.SshConfig, "sshconfig", "", "Read SSH Config file, ie. ~/.ssh/config file")
 	flag.StringVar(&f.OnlyHosts, "only", "", "Filter hosts using regexp")
 	flag.StringVar(&f.ExceptHosts, "except", "", "Filter out hosts using regexp")
+	flag.StringVar(&f.Tags, "tags", "", "Filter hosts using tag selector, ie. role=web,zone!=eu-2")
+	flag.StringVar(&f.Tags, "selector", "", "Filter hosts using tag selector, ie. role=web,zone!=eu-2")
+	flag.StringVar(&f.HostKeyCheck, "host-key-check", "", "Host key checking mode: strict, accept-new or off")
+	flag.StringVar(&f.ControlPath, "control-path", "", "Control socket of the connection master, defaults to ~/.sup/mux.sock")
+	flag.DurationVar(&f.ControlPersist, "control-persist", 0, "Keep connections open in the background for given idle time, ie. 10m")
+	flag.DurationVar(&f.ConnectTimeout, "connect-timeout", 0, "Timeout of connecting to each host, ie. 10s")
+	flag.IntVar(&f.ConnectRetries, "connect-retries", -1, "Retry failed connections given number of times, overrides the network setting if non-negative")
+	flag.DurationVar(&f.RetryBackoff, "retry-backoff", 0, "Delay before the first connection retry, doubled for each next one (default 1s)")
+	flag.DurationVar(&f.ServerAliveInterval, "server-alive-interval", 0, "Send keepalives in given interval, ie. 15s")
+	flag.IntVar(&f.ServerAliveCountMax, "server-alive-count-max", 0, "Disconnect after given number of unanswered keepalives (default 3)")
+	flag.IntVar(&f.Parallel, "parallel", 0, "Connect to and run commands on at most given number of hosts at once")
+	flag.DurationVar(&f.Timeout, "timeout", 0, "Time limit of the commands without their own timeout, ie. 5m")
+	flag.StringVar(&f.Output, "output", "text", "Output format: text, json (NDJSON events on STDOUT), grouped (output block per host) or aggregate")
+	flag.BoolVar(&f.Aggregate, "aggregate", false, "Print each distinct output once with its hosts, same as --output aggregate")
+	flag.Var(&f.Normalize, "normalize", "Ignore the output matching regexp when aggregating, ie. timestamps")
+	flag.StringVar(&f.LogDir, "log-dir", "", "Write each host's output of each command to DIR/<run-id>/<host>/<command>.log")
 	flag.BoolVar(&f.Debug, "D", false, "Enable debug mode")
 	flag.BoolVar(&f.Debug, "debug", false, "Enable debug mode")
 	flag.BoolVar(&f.DisablePrefix, "disable-prefix", false, "Disable hostname prefix")
+	flag.StringVar(&f.PrefixFormat, "prefix-format", "", "Template of the output prefix, ie. '{{.Time}} {{.Alias}} | ', overrides Supfile prefix")
+	flag.BoolVar(&f.DryRun, "dry-run", false, "Print the tasks to be run, don't connect to any host")
 	flag.BoolVar(&f.ShowVersion, "v", false, "Print version")
 	flag.BoolVar(&f.ShowVersion, "version", false, "Print version")
 	flag.BoolVar(&f.ShowHelp, "h", false, "Show help")
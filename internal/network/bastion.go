@@ -0,0 +1,36 @@
+package network
+
+import "strings"
+
+// Bastion is a chain of jump hosts, connected to in the given order.
+// In Supfile, it's either a single hop or a list of hops, each being
+// a "[user@]address[:port]" string or a mapping with address, user,
+// port and identity_file fields.
+type Bastion []Host
+
+func (b *Bastion) UnmarshalYAML(unmarshal func(any) error) error {
+	var hops []Host
+	if err := unmarshal(&hops); err == nil {
+		*b = hops
+		return nil
+	}
+
+	var hop Host
+	if err := unmarshal(&hop); err != nil {
+		return err
+	}
+
+	*b = Bastion{hop}
+
+	return nil
+}
+
+// String returns the hops separated by " -> ".
+func (b Bastion) String() string {
+	hops := make([]string, len(b))
+	for i, hop := range b {
+		hops[i] = hop.String()
+	}
+
+	return strings.Join(hops, " -> ")
+}
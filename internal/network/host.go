@@ -0,0 +1,89 @@
+package network
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/DTreshy/sup/internal/envs"
+)
+
+// Host is a single host of the network. In Supfile, it's either
+// a "[user@]address[:port]" string or a mapping of the fields below.
+type Host struct {
+	Address      string            `yaml:"address"`
+	User         string            `yaml:"user"`
+	Port         int               `yaml:"port"`
+	IdentityFile string            `yaml:"identity_file"`
+	Bastion      Bastion           `yaml:"bastion"` // Jump host(s) for this host only
+	Name         string            `yaml:"name"`    // Display alias used in the output prefix
+	Env          envs.EnvList      `yaml:"env"`     // Overrides the network env
+	Tags         map[string]string `yaml:"tags"`    // Labels for --tags selection, ie. role: db
+}
+
+func (h *Host) UnmarshalYAML(unmarshal func(any) error) error {
+	var address string
+	if err := unmarshal(&address); err == nil {
+		h.Address = address
+		return nil
+	}
+
+	type plainHost Host
+
+	if err := unmarshal((*plainHost)(h)); err != nil {
+		return err
+	}
+
+	if h.Address == "" {
+		return errors.New("host address is required")
+	}
+
+	return nil
+}
+
+// String returns the host in the form of "[user@]address[:port]".
+func (h Host) String() string {
+	host := h.Address
+
+	if h.Port != 0 {
+		host += ":" + strconv.Itoa(h.Port)
+	}
+
+	if h.User != "" {
+		host = h.User + "@" + host
+	}
+
+	return host
+}
+
+// IsLocalhost reports whether the host should be run without SSH.
+func (h Host) IsLocalhost() bool {
+	return h.String() == "localhost"
+}
+
+// TagsEnv returns the host tags as SUP_TAG_<NAME> env vars.
+func (h Host) TagsEnv() envs.EnvList {
+	var env envs.EnvList
+
+	keys := make([]string, 0, len(h.Tags))
+	for key := range h.Tags {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		name := strings.Map(func(r rune) rune {
+			if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+				return r
+			}
+
+			return '_'
+		}, strings.ToUpper(key))
+
+		env.Set("SUP_TAG_"+name, h.Tags[key])
+	}
+
+	return env
+}
@@ -6,6 +6,7 @@ import (
 	"os"
 	"os/exec"
 	"strings"
+	"time"
 
 	"github.com/DTreshy/sup/internal/envs"
 	"github.com/DTreshy/sup/internal/flags"
@@ -15,17 +16,33 @@ import (
 type Network struct {
 	Env       envs.EnvList `yaml:"env"`
 	Inventory string       `yaml:"inventory"`
-	Hosts     []string     `yaml:"hosts"`
-	Bastion   string       `yaml:"bastion"` // Jump host for the environment
-
-	// Should these live on Hosts too? We'd have to change []string to struct, even in Supfile.
-	User         string // `yaml:"user"`
-	IdentityFile string // `yaml:"identity_file"`
+	Hosts     []Host       `yaml:"hosts"`
+	Bastion   Bastion      `yaml:"bastion"` // Jump host(s) for the environment
+	Tunnels   []Tunnel     `yaml:"tunnels"` // Port forwardings open around every command
+
+	KnownHosts   string `yaml:"known_hosts"`    // Extra known_hosts file, new keys are stored there
+	HostKeyCheck string `yaml:"host_key_check"` // strict (default), accept-new or off
+
+	User           string `yaml:"user"`            // Default user for all hosts
+	IdentityFile   string `yaml:"identity_file"`   // Default private key for all hosts
+	IdentitiesOnly bool   `yaml:"identities_only"` // Don't offer ssh-agent and ~/.ssh/id_* keys
+	ForwardAgent   bool   `yaml:"forward_agent"`   // Forward the local ssh-agent to all the commands
+
+	ConnectTimeout      time.Duration `yaml:"connect_timeout"`        // Timeout of connecting to each host, ie. 10s
+	ConnectRetries      int           `yaml:"connect_retries"`        // Retries of the failed connections
+	RetryBackoff        time.Duration `yaml:"retry_backoff"`          // Delay before the first retry, 1s by default
+	ServerAliveInterval time.Duration `yaml:"server_alive_interval"`  // Keepalive interval, ie. 15s
+	ServerAliveCountMax int           `yaml:"server_alive_count_max"` // Unanswered keepalives before disconnecting
+	MaxParallel         int           `yaml:"max_parallel"`           // Hosts connected to and running a command at once, all by default
+
+	ControlPath    string        `yaml:"control_path"`    // Control socket of the connection master
+	ControlPersist time.Duration `yaml:"control_persist"` // Keep unused connections open for, ie. 10m
 }
 
 // ParseInventory runs the inventory command, if provided, and appends
 // the command's output lines to the manually defined list of hosts.
-func (n Network) ParseInventory() ([]string, error) {
+// Each line is a host, optionally followed by space separated key=value tags.
+func (n Network) ParseInventory() ([]Host, error) {
 	if n.Inventory == "" {
 		return nil, nil
 	}
@@ -44,32 +61,48 @@ func (n Network) ParseInventory() ([]string, error) {
 		return nil, err
 	}
 
-	var hosts []string
+	var hosts []Host
 
 	buf := bytes.NewBuffer(output)
 
 	for {
-		host, err := buf.ReadString('\n')
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-
+		line, err := buf.ReadString('\n')
+		if err != nil && err != io.EOF {
 			return nil, err
 		}
 
-		host = strings.TrimSpace(host)
+		line = strings.TrimSpace(line)
 		// skip empty lines and comments
-		if host == "" || host[:1] == "#" {
-			continue
+		if line != "" && line[:1] != "#" {
+			hosts = append(hosts, parseInventoryLine(line))
 		}
 
-		hosts = append(hosts, host)
+		if err == io.EOF {
+			break
+		}
 	}
 
 	return hosts, nil
 }
 
+// parseInventoryLine parses "host [key=value ...]" inventory line.
+func parseInventoryLine(line string) Host {
+	fields := strings.Fields(line)
+	host := Host{Address: fields[0]}
+
+	for _, field := range fields[1:] {
+		key, value, _ := strings.Cut(field, "=")
+
+		if host.Tags == nil {
+			host.Tags = map[string]string{}
+		}
+
+		host.Tags[key] = value
+	}
+
+	return host
+}
+
 func (n *Network) SetEnvs(vars flags.FlagStringSlice) {
 	// Parse CLI --env flag env vars, override values defined in Network env.
 	for _, env := range vars {
@@ -79,11 +112,16 @@ func (n *Network) SetEnvs(vars flags.FlagStringSlice) {
 
 		val := strings.SplitN(env, "=", 2)
 		if len(val) == 1 {
-			n.Env.Set(env, "")
-
-			continue
+			val = append(val, "")
 		}
 
 		n.Env.Set(val[0], val[1])
+
+		// CLI env vars override the host env too.
+		for i := range n.Hosts {
+			if len(n.Hosts[i].Env) > 0 {
+				n.Hosts[i].Env.Set(val[0], val[1])
+			}
+		}
 	}
 }
@@ -0,0 +1,96 @@
+package network
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Selector filters hosts by their tags. It's a comma separated list of
+// requirements, all of which must be met:
+//
+//	key=value      tag equals value
+//	key=v1|v2      tag equals any of the values
+//	key!=value     tag doesn't equal value (or is not set)
+//	key            tag is set
+//	!key           tag is not set
+type Selector []requirement
+
+type requirement struct {
+	key    string
+	values []string
+	negate bool
+}
+
+// ParseSelector parses the selector expression, ie. "role=web,zone!=eu-2".
+func ParseSelector(expr string) (Selector, error) {
+	var selector Selector
+
+	for _, term := range strings.Split(expr, ",") {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+
+		var req requirement
+
+		switch {
+		case strings.Contains(term, "!="):
+			key, values, _ := strings.Cut(term, "!=")
+			req = requirement{key: key, values: strings.Split(values, "|"), negate: true}
+		case strings.Contains(term, "="):
+			key, values, _ := strings.Cut(term, "=")
+			req = requirement{key: key, values: strings.Split(values, "|")}
+		case strings.HasPrefix(term, "!"):
+			req = requirement{key: term[1:], negate: true}
+		default:
+			req = requirement{key: term}
+		}
+
+		req.key = strings.TrimSpace(req.key)
+		if req.key == "" {
+			return nil, fmt.Errorf("invalid selector %q: missing tag name in %q", expr, term)
+		}
+
+		for i, value := range req.values {
+			req.values[i] = strings.TrimSpace(value)
+		}
+
+		selector = append(selector, req)
+	}
+
+	if len(selector) == 0 {
+		return nil, fmt.Errorf("invalid selector %q: no requirements", expr)
+	}
+
+	return selector, nil
+}
+
+// Matches reports whether the host's tags meet all the requirements.
+func (s Selector) Matches(host Host) bool {
+	for _, req := range s {
+		if !req.matches(host.Tags) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (r requirement) matches(tags map[string]string) bool {
+	value, ok := tags[r.key]
+
+	if len(r.values) == 0 {
+		return ok != r.negate
+	}
+
+	found := false
+
+	for _, v := range r.values {
+		if ok && v == value {
+			found = true
+			break
+		}
+	}
+
+	return found != r.negate
+}
@@ -0,0 +1,79 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Tunnel is a TCP port forwarding, open while a command runs. In Supfile,
+// it's either a "local" (ssh -L) or a "remote" (ssh -R) forwarding in the
+// "[bind_address:]port:host:hostport" form. Port 0 picks any free port.
+type Tunnel struct {
+	Reverse bool   // Listens on the host and connects from localhost (-R).
+	Listen  string // Address to listen on, "localhost" unless bound explicitly.
+	Connect string // Address to connect to from the other side.
+	Env     string // Env var the bound port is exported as, if set.
+}
+
+func (t *Tunnel) UnmarshalYAML(unmarshal func(any) error) error {
+	var spec struct {
+		Local  string `yaml:"local"`
+		Remote string `yaml:"remote"`
+		Env    string `yaml:"env"`
+	}
+
+	if err := unmarshal(&spec); err != nil {
+		return err
+	}
+
+	forward := spec.Local
+	if spec.Remote != "" {
+		if spec.Local != "" {
+			return errors.New("tunnel must be either local or remote, not both")
+		}
+
+		forward = spec.Remote
+		t.Reverse = true
+	}
+
+	listen, connect, err := parseForward(forward)
+	if err != nil {
+		return err
+	}
+
+	t.Listen, t.Connect, t.Env = listen, connect, spec.Env
+
+	return nil
+}
+
+// parseForward splits the "[bind_address:]port:host:hostport" forwarding
+// into the addresses to listen on and to connect to.
+func parseForward(forward string) (string, string, error) {
+	if forward == "" {
+		return "", "", errors.New("tunnel requires local or remote forwarding")
+	}
+
+	parts := strings.Split(forward, ":")
+
+	switch len(parts) {
+	case 3:
+		parts = append([]string{"localhost"}, parts...)
+	case 4:
+	default:
+		return "", "", fmt.Errorf("invalid tunnel %q, expected [bind_address:]port:host:hostport", forward)
+	}
+
+	return net.JoinHostPort(parts[0], parts[1]), net.JoinHostPort(parts[2], parts[3]), nil
+}
+
+// String returns the forwarding in the ssh command line form.
+func (t Tunnel) String() string {
+	flag := "-L"
+	if t.Reverse {
+		flag = "-R"
+	}
+
+	return fmt.Sprintf("%v %v:%v", flag, t.Listen, t.Connect)
+}
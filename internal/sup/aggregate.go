@@ -0,0 +1,279 @@
+package sup
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pmezard/go-difflib/difflib"
+)
+
+const (
+	// aggregateMaxNames is the number of hosts listed in the group's header.
+	aggregateMaxNames = 10
+
+	// normalizedMark replaces the parts of the output matching --normalize.
+	normalizedMark = "*"
+)
+
+// Normalize sets the regexps of the output parts to be ignored
+// when aggregating the hosts' output, ie. timestamps.
+func (sup *Stackup) Normalize(exprs []string) error {
+	sup.normalize = nil
+
+	for _, expr := range exprs {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return fmt.Errorf("invalid normalize regexp %q: %w", expr, err)
+		}
+
+		sup.normalize = append(sup.normalize, re)
+	}
+
+	return nil
+}
+
+// aggregateOutput buffers the hosts' output as groupedOutput does, but once
+// all the hosts finish the task, it prints each distinct output only once,
+// with the list of the hosts, and the diffs of the outliers to the majority.
+type aggregateOutput struct {
+	*groupedOutput
+
+	mu      sync.Mutex
+	pending map[*Task][]hostOutput // Hosts that finished the task.
+}
+
+// hostOutput is the output of the task on a single host.
+type hostOutput struct {
+	name   string
+	client Client
+	result *TaskResult
+	text   string // STDOUT followed by STDERR.
+}
+
+// outputGroup are the hosts with the same normalized output and status.
+type outputGroup struct {
+	hosts      []hostOutput
+	normalized string
+}
+
+func newAggregateOutput(text textOutput) *aggregateOutput {
+	return &aggregateOutput{
+		groupedOutput: newGroupedOutput(text),
+		pending:       map[*Task][]hostOutput{},
+	}
+}
+
+func (o *aggregateOutput) taskEnd(task *Task, c Client, res *TaskResult) {
+	if task.Stream {
+		o.groupedOutput.taskEnd(task, c, res)
+		return
+	}
+
+	block := o.takeBlock(task, c)
+
+	text := block.stdout.String()
+	if block.stderr.Len() > 0 {
+		text += "--- stderr\n" + block.stderr.String()
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	// Each client of the task ends it exactly once.
+	o.pending[task] = append(o.pending[task], hostOutput{name: block.name, client: c, result: res, text: text})
+	if len(o.pending[task]) < len(task.Clients) {
+		return
+	}
+
+	outputs := o.pending[task]
+	delete(o.pending, task)
+
+	o.print(task, outputs)
+}
+
+// takeBlock removes the client's buffered output of the task.
+func (o *aggregateOutput) takeBlock(task *Task, c Client) *outputBlock {
+	o.groupedOutput.mu.Lock()
+	defer o.groupedOutput.mu.Unlock()
+
+	key := groupKey{task, c}
+
+	block, ok := o.blocks[key]
+	if !ok {
+		// The task failed to start, or was skipped.
+		return &outputBlock{name: hostName(c)}
+	}
+
+	delete(o.blocks, key)
+
+	return block
+}
+
+// print prints the groups of the hosts with the same output, the largest first.
+// Hosts are listed in the network order.
+func (o *aggregateOutput) print(task *Task, outputs []hostOutput) {
+	var (
+		groups  []*outputGroup
+		skipped int
+	)
+
+	order := map[Client]int{}
+	for i, c := range task.Clients {
+		order[c] = i
+	}
+
+	sort.SliceStable(outputs, func(i, j int) bool {
+		return order[outputs[i].client] < order[outputs[j].client]
+	})
+
+	for _, out := range outputs {
+		if out.result.Status == TaskSkipped {
+			skipped++
+			continue
+		}
+
+		normalized := o.normalized(out)
+
+		var group *outputGroup
+
+		for _, g := range groups {
+			if g.normalized == normalized {
+				group = g
+				break
+			}
+		}
+
+		if group == nil {
+			group = &outputGroup{normalized: normalized}
+			groups = append(groups, group)
+		}
+
+		group.hosts = append(group.hosts, out)
+	}
+
+	if len(groups) == 0 {
+		return
+	}
+
+	sort.SliceStable(groups, func(i, j int) bool {
+		return len(groups[i].hosts) > len(groups[j].hosts)
+	})
+
+	hosts := len(outputs) - skipped
+
+	if len(groups) == 1 {
+		fmt.Fprintf(os.Stdout, "=== %v: same output on %v\n", task.Name, pluralHosts(hosts))
+	} else {
+		fmt.Fprintf(os.Stdout, "=== %v: %v different outputs on %v\n", task.Name, len(groups), pluralHosts(hosts))
+	}
+
+	if skipped > 0 {
+		fmt.Fprintf(os.Stdout, "(%v skipped)\n", pluralHosts(skipped))
+	}
+
+	for _, group := range groups {
+		fmt.Fprintf(os.Stdout, "--- %v: %v\n", group.title(), group.status())
+		writeBlock(os.Stdout, []byte(group.hosts[0].text))
+	}
+
+	// Outliers compared to the majority.
+	majority := groups[0]
+
+	for _, group := range groups[1:] {
+		diff, err := group.diff(majority)
+		if err != nil {
+			continue
+		}
+
+		fmt.Fprintln(os.Stdout, "--- diff")
+		writeBlock(os.Stdout, []byte(diff))
+	}
+}
+
+// normalized returns the host's output and status, with the line endings,
+// trailing whitespace and the parts matching --normalize regexps unified.
+func (o *aggregateOutput) normalized(out hostOutput) string {
+	text := strings.ReplaceAll(out.text, "\r\n", "\n")
+
+	for _, re := range o.sup.normalize {
+		text = re.ReplaceAllString(text, normalizedMark)
+	}
+
+	lines := strings.Split(strings.TrimRight(text, " \t\r\n"), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " \t\r")
+	}
+
+	text = strings.Join(lines, "\n")
+	if text != "" {
+		text += "\n"
+	}
+
+	// Hosts failing with the same output are a group of their own.
+	if out.result.Status != TaskOK {
+		text += fmt.Sprintf("(%v, exit status %v)\n", out.result.Status, out.result.ExitStatus)
+	}
+
+	return text
+}
+
+// title lists the group's hosts, up to aggregateMaxNames of them.
+func (g *outputGroup) title() string {
+	var names []string
+
+	for i, host := range g.hosts {
+		if i == aggregateMaxNames {
+			names = append(names, fmt.Sprintf("%v more", len(g.hosts)-i))
+			break
+		}
+
+		names = append(names, host.name)
+	}
+
+	return fmt.Sprintf("%v (%v)", pluralHosts(len(g.hosts)), strings.Join(names, ", "))
+}
+
+// diff returns the unified diff of the majority's output to the group's one.
+func (g *outputGroup) diff(majority *outputGroup) (string, error) {
+	return difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        splitLines(majority.normalized),
+		B:        splitLines(g.normalized),
+		FromFile: majority.title(),
+		ToFile:   g.title(),
+		Context:  3,
+	})
+}
+
+func (g *outputGroup) status() string {
+	res := g.hosts[0].result
+
+	status := fmt.Sprintf("%v, exit status %v", res.Status, res.ExitStatus)
+	if res.Err != nil && res.Status != TaskOK {
+		status += ", " + firstLine(res.Err)
+	}
+
+	return status
+}
+
+// splitLines splits the text to the lines, keeping their line endings,
+// which the diff lines are terminated by.
+func splitLines(text string) []string {
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	return lines
+}
+
+func pluralHosts(n int) string {
+	if n == 1 {
+		return "1 host"
+	}
+
+	return fmt.Sprintf("%v hosts", n)
+}
@@ -0,0 +1,68 @@
+package sup
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOutputGroupDiff(t *testing.T) {
+	tests := []struct {
+		name     string
+		majority string
+		outlier  string
+		want     string
+	}{
+		{
+			name:     "single line",
+			majority: "1.4.2\n",
+			outlier:  "1.4.1\n",
+			want: `--- 2 hosts (api1, api2)
++++ 1 host (api3)
+@@ -1 +1 @@
+-1.4.2
++1.4.1
+`,
+		},
+		{
+			name:     "multiple lines",
+			majority: "a\nb\nc\n",
+			outlier:  "a\nc\nd\n",
+			want: `--- 2 hosts (api1, api2)
++++ 1 host (api3)
+@@ -1,3 +1,3 @@
+ a
+-b
+ c
++d
+`,
+		},
+		{
+			name:     "no output",
+			majority: "ok\n",
+			outlier:  "",
+			want: `--- 2 hosts (api1, api2)
++++ 1 host (api3)
+@@ -1 +0,0 @@
+-ok
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			majority := &outputGroup{
+				hosts:      []hostOutput{{name: "api1"}, {name: "api2"}},
+				normalized: tt.majority,
+			}
+			outlier := &outputGroup{
+				hosts:      []hostOutput{{name: "api3"}},
+				normalized: tt.outlier,
+			}
+
+			diff, err := outlier.diff(majority)
+			require.NoError(t, err)
+			require.Equal(t, tt.want, diff)
+		})
+	}
+}
@@ -0,0 +1,254 @@
+package sup
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/term"
+)
+
+var (
+	agentOnce   sync.Once
+	agentClient agent.ExtendedAgent
+
+	// Decrypted identities are cached for the whole run, so the user
+	// is asked for each passphrase once only.
+	identitiesMu sync.Mutex
+	identities   = map[string]ssh.Signer{}
+)
+
+// sshAgent returns client of the running SSH Agent, or nil if there's none.
+func sshAgent() agent.ExtendedAgent {
+	agentOnce.Do(func() {
+		sock, err := net.Dial("unix", os.Getenv("SSH_AUTH_SOCK"))
+		if err == nil {
+			agentClient = agent.NewClient(sock)
+		}
+	})
+
+	return agentClient
+}
+
+// forwardAgent requests ssh-agent forwarding for the session.
+// The local ssh-agent is served to the host on first use.
+func (c *SSHClient) forwardAgent(sess *ssh.Session) error {
+	c.agentOnce.Do(func() {
+		keyring := sshAgent()
+		if keyring == nil {
+			c.agentErr = errors.New("agent forwarding requires a running ssh-agent (SSH_AUTH_SOCK)")
+			return
+		}
+
+		c.agentErr = agent.ForwardToAgent(c.conn, keyring)
+	})
+
+	if c.agentErr != nil {
+		return c.agentErr
+	}
+
+	return agent.RequestAgentForwarding(sess)
+}
+
+// authMethods returns SSH authentication methods for the client along
+// with a human readable list of the identities offered to the server.
+// Explicitly set auth methods take precedence.
+//
+// The client's identity file is offered first. Unless identitiesOnly is
+// set, all the SSH Agent keys and the ~/.ssh/id_* keys follow.
+func (c *SSHClient) authMethods() ([]ssh.AuthMethod, []string, error) {
+	if c.auth != nil {
+		return c.auth, nil, nil
+	}
+
+	signers, tried, err := c.signers()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return []ssh.AuthMethod{ssh.PublicKeys(signers...)}, tried, nil
+}
+
+// signers returns the identities to be offered to the server, along
+// with their human readable names.
+func (c *SSHClient) signers() ([]ssh.Signer, []string, error) {
+	var (
+		signers []ssh.Signer
+		tried   []string
+	)
+
+	if c.identityFile != "" {
+		signer, err := loadIdentity(c.identityFile)
+		if err != nil {
+			return nil, nil, errors.Join(err, fmt.Errorf("loading identity %v failed", c.identityFile))
+		}
+
+		signers = append(signers, signer)
+		tried = append(tried, c.identityFile)
+	}
+
+	if !c.identitiesOnly {
+		if sshAgent := sshAgent(); sshAgent != nil {
+			agentSigners, err := sshAgent.Signers()
+			if err == nil && len(agentSigners) > 0 {
+				signers = append(signers, agentSigners...)
+				tried = append(tried, fmt.Sprintf("ssh-agent (%v keys)", len(agentSigners)))
+			}
+		}
+
+		// Try to read user's SSH private keys form the standard paths.
+		files, _ := filepath.Glob(os.Getenv("HOME") + "/.ssh/id_*")
+
+		for _, file := range files {
+			if strings.HasSuffix(file, ".pub") || file == c.identityFile {
+				continue // Skip public keys and the already loaded identity.
+			}
+
+			signer, err := loadIdentity(file)
+			if err != nil {
+				continue
+			}
+
+			signers = append(signers, signer)
+			tried = append(tried, file)
+		}
+	}
+
+	if len(signers) == 0 {
+		return nil, nil, errors.New("no SSH identities available")
+	}
+
+	return signers, tried, nil
+}
+
+// loadIdentity reads private key from the file. Passphrase protected keys
+// are decrypted lazily, only once the server accepts their public key.
+func loadIdentity(file string) (ssh.Signer, error) {
+	identitiesMu.Lock()
+	signer, ok := identities[file]
+	identitiesMu.Unlock()
+
+	if ok {
+		return signer, nil
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err = ssh.ParsePrivateKey(data)
+	if err == nil {
+		identitiesMu.Lock()
+		identities[file] = signer
+		identitiesMu.Unlock()
+
+		return signer, nil
+	}
+
+	var missing *ssh.PassphraseMissingError
+	if !errors.As(err, &missing) {
+		return nil, err
+	}
+
+	pub := missing.PublicKey
+	if pub == nil {
+		// Older key formats don't carry the public key, look for the .pub file.
+		if data, err := os.ReadFile(file + ".pub"); err == nil {
+			pub, _, _, _, _ = ssh.ParseAuthorizedKey(data)
+		}
+	}
+
+	encrypted := &encryptedSigner{file: file, data: data, pub: pub}
+
+	if pub == nil {
+		// Can't offer the key without knowing it, decrypt it right away.
+		return encrypted.decrypt()
+	}
+
+	return encrypted, nil
+}
+
+// encryptedSigner is a passphrase protected key, which asks for
+// the passphrase on its first use.
+type encryptedSigner struct {
+	file string
+	data []byte
+	pub  ssh.PublicKey
+}
+
+func (s *encryptedSigner) PublicKey() ssh.PublicKey {
+	return s.pub
+}
+
+func (s *encryptedSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	signer, err := s.decrypt()
+	if err != nil {
+		return nil, err
+	}
+
+	return signer.Sign(rand, data)
+}
+
+func (s *encryptedSigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
+	signer, err := s.decrypt()
+	if err != nil {
+		return nil, err
+	}
+
+	algSigner, ok := signer.(ssh.AlgorithmSigner)
+	if !ok {
+		return nil, fmt.Errorf("%v: key doesn't support %v signatures", s.file, algorithm)
+	}
+
+	return algSigner.SignWithAlgorithm(rand, data, algorithm)
+}
+
+// decrypt asks for the passphrase and decrypts the key. Hosts connect
+// in parallel, so the prompts are serialized and the result is cached.
+func (s *encryptedSigner) decrypt() (ssh.Signer, error) {
+	identitiesMu.Lock()
+	defer identitiesMu.Unlock()
+
+	if signer, ok := identities[s.file]; ok {
+		return signer, nil
+	}
+
+	passphrase, err := readPassphrase(s.file)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := ssh.ParsePrivateKeyWithPassphrase(s.data, passphrase)
+	if err != nil {
+		return nil, errors.Join(err, fmt.Errorf("decrypting %v failed", s.file))
+	}
+
+	identities[s.file] = signer
+
+	return signer, nil
+}
+
+// readPassphrase asks the user for the passphrase of the key file.
+func readPassphrase(file string) ([]byte, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return nil, errors.Join(err, fmt.Errorf("%v is passphrase protected, but there's no terminal to ask for it", file))
+	}
+	defer tty.Close()
+
+	fmt.Fprintf(tty, "Enter passphrase for key '%v': ", file)
+
+	passphrase, err := term.ReadPassword(int(tty.Fd()))
+
+	fmt.Fprintln(tty)
+
+	return passphrase, err
+}
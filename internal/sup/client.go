@@ -1,6 +1,7 @@
 package sup
 
 import (
+	"fmt"
 	"io"
 	"os"
 )
@@ -11,10 +12,103 @@ type Client interface {
 	Wait() error
 	Close() error
 	Prefix() (string, int)
+	Host() string
 	Write(p []byte) (n int, err error)
 	WriteClose() error
 	Stdin() io.WriteCloser
 	Stderr() io.Reader
 	Stdout() io.Reader
 	Signal(os.Signal) error
+	Kill() error // Stops the running command forcibly.
+}
+
+// hostID returns the unique name of the client's host in the run: its address,
+// unless shared with the other hosts of the network, see identify.
+func hostID(c Client) string {
+	switch c := c.(type) {
+	case *SSHClient:
+		if c.id != "" {
+			return c.id
+		}
+	case *LocalhostClient:
+		if c.id != "" {
+			return c.id
+		}
+	}
+
+	return c.Host()
+}
+
+// identify sets unique IDs of the clients sharing the same address:
+// user@host if their users differ, numbered in the network order otherwise.
+func identify(clients []Client) {
+	hosts := map[string]int{}
+	for _, c := range clients {
+		if c.Host() != "" { // Failed before resolving the address.
+			hosts[c.Host()]++
+		}
+	}
+
+	users := map[string]int{}
+	for _, c := range clients {
+		if hosts[c.Host()] > 1 {
+			users[userHost(c)]++
+		}
+	}
+
+	seen := map[string]int{}
+
+	for _, c := range clients {
+		if hosts[c.Host()] < 2 {
+			continue
+		}
+
+		id := userHost(c)
+		if users[id] > 1 {
+			seen[id]++
+			id = fmt.Sprintf("%v#%v", id, seen[id])
+		}
+
+		switch c := c.(type) {
+		case *SSHClient:
+			c.id = id
+		case *LocalhostClient:
+			c.id = id
+		}
+	}
+}
+
+// userHost returns the client's user@host, or just the host if the user
+// is unknown.
+func userHost(c Client) string {
+	user := ""
+
+	switch c := c.(type) {
+	case *SSHClient:
+		user = c.user
+	case *LocalhostClient:
+		user = c.user
+	}
+
+	if user == "" {
+		return c.Host()
+	}
+
+	return user + "@" + c.Host()
+}
+
+// hostName returns the alias of the client's host, or its ID.
+func hostName(c Client) string {
+	switch c := c.(type) {
+	case *SSHClient:
+		if c.name != "" {
+			return c.name
+		}
+	case *LocalhostClient:
+		if c.name != "" {
+			return c.name
+		}
+	}
+
+	return hostID(c)
 }
@@ -0,0 +1,426 @@
+package sup
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/DTreshy/sup/internal/network"
+	"github.com/DTreshy/sup/pkg/colors"
+)
+
+// errUnreachable is returned by connect if any host is unreachable.
+var errUnreachable = errors.New("connecting to clients failed")
+
+// connect creates clients for every host of the network (either SSH or Localhost).
+// Clients are returned in the order of network hosts, skipping unreachable ones.
+// The unreachable hosts are recorded in the report.
+func (sup *Stackup) connect(net *network.Network, env string) ([]Client, *RunReport, error) {
+	hosts := make([]string, len(net.Hosts))
+	for i, host := range net.Hosts {
+		hosts[i] = host.String()
+	}
+
+	report := newRunReport(hosts)
+
+	hostKeyCallback, err := NewHostKeyCallback(net.HostKeyCheck, net.KnownHosts)
+	if err != nil {
+		return nil, report, errors.Join(err, errors.New("setting up host key verification failed"))
+	}
+
+	sup.bastions = sup.newBastions(net, hostKeyCallback)
+
+	var mux *muxConfig
+	if net.ControlPersist > 0 {
+		mux = newMuxConfig(controlPath(net), net.ControlPersist, net.HostKeyCheck, net.KnownHosts)
+	}
+
+	var wg sync.WaitGroup
+
+	all := make([]Client, len(net.Hosts))
+	connected := make([]Client, len(net.Hosts))
+	errs := make([]error, len(net.Hosts))
+
+	// Don't trip the hosts' (or bastion's) MaxStartups by dialing all at once.
+	slots := newSlots(net.MaxParallel)
+
+	for i, host := range net.Hosts {
+		wg.Add(1)
+
+		go func(i int, host network.Host) {
+			defer wg.Done()
+
+			slots.acquire()
+			defer slots.release()
+
+			client := sup.newClient(i, host, net, env, hostKeyCallback)
+			all[i] = client
+
+			// Localhost client.
+			if local, ok := client.(*LocalhostClient); ok {
+				if err := local.Connect(host.String()); err != nil {
+					errs[i] = errors.Join(err, errors.New("connecting to localhost failed"))
+					return
+				}
+
+				connected[i] = local
+
+				return
+			}
+
+			// SSH client.
+			remote := client.(*SSHClient)
+
+			// Reuse the connection kept by the control master.
+			if mux != nil {
+				hops := make([]*SSHClient, len(remote.jumps))
+
+				for j, hop := range remote.jumps {
+					hops[j] = sup.bastions.newConn(hop)
+					if err := hops[j].parseHost(hops[j].addr); err != nil {
+						errs[i] = errors.Join(err, errors.New("connecting to bastion failed"))
+						return
+					}
+				}
+
+				if err := remote.connectMux(remote.addr, hops, mux); err != nil {
+					errs[i] = errors.Join(err, errors.New("connecting to remote host through control socket failed"))
+					return
+				}
+
+				connected[i] = remote
+
+				return
+			}
+
+			if len(remote.jumps) > 0 {
+				bastion, err := sup.bastions.get(remote.jumps)
+				if err != nil {
+					errs[i] = errors.Join(err, errors.New("connecting to bastion failed"))
+					return
+				}
+
+				if err := remote.ConnectWith(remote.addr, bastion.DialThrough); err != nil {
+					errs[i] = errors.Join(err, errors.New("connecting to remote host through bastion failed"))
+					return
+				}
+			} else {
+				if err := remote.Connect(remote.addr); err != nil {
+					errs[i] = errors.Join(err, errors.New("connecting to remote host failed"))
+					return
+				}
+			}
+
+			connected[i] = remote
+		}(i, host)
+	}
+
+	wg.Wait()
+
+	// Hosts sharing the address are told apart in the report and the output.
+	identify(all)
+
+	var clients []Client
+
+	for i, client := range connected {
+		if client == nil {
+			if all[i].Host() != "" {
+				report.Hosts[i] = hostID(all[i])
+			}
+
+			report.Unreachable[report.Hosts[i]] = errs[i]
+			sup.out.hostFailed(report.Hosts[i], errs[i])
+
+			continue
+		}
+
+		sup.out.hostConnected(client)
+
+		report.Hosts[i] = hostID(client)
+
+		_, prefixLen := client.Prefix()
+		if prefixLen > sup.maxLen {
+			sup.maxLen = prefixLen
+		}
+
+		clients = append(clients, client)
+	}
+
+	if len(report.Unreachable) > 0 {
+		return clients, report, errUnreachable
+	}
+
+	return clients, report, nil
+}
+
+// newClient creates unconnected client for i-th host of the network.
+// Host settings take precedence over the network ones, which take
+// precedence over ssh_config.
+func (sup *Stackup) newClient(i int, host network.Host, net *network.Network, env string, hostKeyCallback ssh.HostKeyCallback) Client {
+	tags := host.TagsEnv()
+	env += tags.AsExport() + host.Env.AsExport() + `export SUP_HOST="` + host.String() + `";`
+
+	if host.IsLocalhost() {
+		return &LocalhostClient{
+			env:  env,
+			name: host.Name,
+		}
+	}
+
+	identityFile := net.IdentityFile
+	if host.IdentityFile != "" {
+		identityFile = host.IdentityFile
+	}
+
+	c := &SSHClient{
+		env:   env,
+		user:  net.User,
+		name:  host.Name,
+		color: colors.Colors[i%len(colors.Colors)],
+
+		hostKeyCallback: hostKeyCallback,
+		identityFile:    identityFile,
+		identitiesOnly:  net.IdentitiesOnly,
+		agentForwarding: net.ForwardAgent,
+	}
+
+	setConnectOptions(c, net)
+
+	jumps := sup.configure(c, host.String())
+
+	switch {
+	case len(host.Bastion) > 0:
+		c.jumps = host.Bastion
+	case len(net.Bastion) > 0:
+		c.jumps = net.Bastion
+	default:
+		c.jumps = jumpHosts(jumps)
+	}
+
+	c.jumps = sup.proxyJumps(c.jumps, net.User)
+
+	return c
+}
+
+// proxyJumps prepends the ProxyJump hosts of the first hop of the chain,
+// as it's the only hop connected to directly. Later hops are reached through
+// the preceding ones, so their ProxyJump is ignored, as in OpenSSH.
+func (sup *Stackup) proxyJumps(chain network.Bastion, defaultUser string) network.Bastion {
+	seen := map[string]bool{}
+
+	for len(chain) > 0 && !seen[chain[0].String()] {
+		seen[chain[0].String()] = true
+
+		user, hostname, _ := splitHost(chain[0].String())
+		if user == "" {
+			user = defaultUser
+		}
+
+		jumps := sup.sshConfig.Lookup(hostname, user).ProxyJump
+		if len(jumps) == 0 {
+			break
+		}
+
+		chain = append(jumpHosts(jumps), chain...)
+	}
+
+	return chain
+}
+
+// jumpHosts returns the bastion of the ProxyJump hosts.
+func jumpHosts(jumps []string) network.Bastion {
+	var chain network.Bastion
+
+	for _, hop := range jumps {
+		chain = append(chain, network.Host{Address: hop})
+	}
+
+	return chain
+}
+
+// setConnectOptions sets the connection timeouts, retries and keepalives
+// of the network to the client.
+func setConnectOptions(c *SSHClient, net *network.Network) {
+	c.connectTimeout = net.ConnectTimeout
+	c.connectRetries = net.ConnectRetries
+	c.retryBackoff = net.RetryBackoff
+	c.serverAliveInterval = net.ServerAliveInterval
+	c.serverAliveCountMax = net.ServerAliveCountMax
+}
+
+// configure applies ssh_config of the "[user@]host[:port]" host to the client
+// and sets the client's address to connect to. Settings already set on the
+// client take precedence. It returns the ProxyJump hosts of the host.
+func (sup *Stackup) configure(c *SSHClient, host string) []string {
+	user, hostname, port := splitHost(host)
+	if user == "" {
+		user = c.user
+	}
+
+	conf := sup.sshConfig.Lookup(hostname, user)
+
+	if conf.HostName != "" && conf.HostName != hostname {
+		if c.name == "" {
+			c.name = hostname // Keep the alias in the output prefix.
+		}
+
+		hostname = conf.HostName
+	}
+
+	if user == "" {
+		user = conf.User
+	}
+
+	if port == "" && conf.Port != 0 {
+		port = strconv.Itoa(conf.Port)
+	}
+
+	if c.identityFile == "" && len(conf.IdentityFiles) > 0 {
+		c.identityFile = conf.IdentityFiles[0]
+	}
+
+	c.identitiesOnly = c.identitiesOnly || conf.IdentitiesOnly
+	c.agentForwarding = c.agentForwarding || conf.ForwardAgent
+
+	if c.serverAliveInterval == 0 {
+		c.serverAliveInterval = conf.ServerAliveInterval
+	}
+
+	if c.serverAliveCountMax == 0 {
+		c.serverAliveCountMax = conf.ServerAliveCountMax
+	}
+
+	if c.connectTimeout == 0 {
+		c.connectTimeout = conf.ConnectTimeout
+	}
+
+	if c.connectRetries == 0 && conf.ConnectionAttempts > 1 {
+		c.connectRetries = conf.ConnectionAttempts - 1
+	}
+
+	c.addr = hostname
+	if port != "" {
+		c.addr += ":" + port
+	}
+
+	if user != "" {
+		c.addr = user + "@" + c.addr
+	}
+
+	return conf.ProxyJump
+}
+
+// controlPath returns the control socket of the network,
+// ~/.sup/mux.sock by default.
+func controlPath(net *network.Network) string {
+	if net.ControlPath != "" {
+		return net.ControlPath
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		home = os.TempDir()
+	}
+
+	return filepath.Join(home, ".sup", "mux.sock")
+}
+
+// bastions keeps the jump host connections. Connection to each hop is shared
+// by all the hosts connecting through the same chain of jump hosts.
+type bastions struct {
+	mu      sync.Mutex
+	conns   map[string]*bastionConn // By the chain of hops, up to the connected hop.
+	newConn func(hop network.Host) *SSHClient
+}
+
+type bastionConn struct {
+	once   sync.Once
+	client *SSHClient
+	err    error
+}
+
+func (sup *Stackup) newBastions(net *network.Network, hostKeyCallback ssh.HostKeyCallback) *bastions {
+	return &bastions{
+		conns: map[string]*bastionConn{},
+		newConn: func(hop network.Host) *SSHClient {
+			identityFile := net.IdentityFile
+			if hop.IdentityFile != "" {
+				identityFile = hop.IdentityFile
+			}
+
+			c := &SSHClient{
+				user:            net.User,
+				hostKeyCallback: hostKeyCallback,
+				identityFile:    identityFile,
+				identitiesOnly:  net.IdentitiesOnly,
+			}
+
+			setConnectOptions(c, net)
+			sup.configure(c, hop.String())
+
+			return c
+		},
+	}
+}
+
+// get returns connection to the last hop of the chain, connecting
+// to the hops on first use.
+func (b *bastions) get(chain network.Bastion) (*SSHClient, error) {
+	// Hops are identified by the resolved addresses, so the chains
+	// written differently in Supfile still share the connections.
+	var key string
+
+	for _, hop := range chain {
+		c := b.newConn(hop)
+		if err := c.parseHost(c.addr); err != nil {
+			return nil, err
+		}
+
+		key += fmt.Sprintf("%v@%v %v -> ", c.user, c.host, c.identityFile)
+	}
+
+	b.mu.Lock()
+
+	conn, ok := b.conns[key]
+	if !ok {
+		conn = &bastionConn{}
+		b.conns[key] = conn
+	}
+
+	b.mu.Unlock()
+
+	conn.once.Do(func() {
+		conn.client = b.newConn(chain[len(chain)-1])
+
+		if len(chain) == 1 {
+			conn.err = conn.client.Connect(conn.client.addr)
+			return
+		}
+
+		prev, err := b.get(chain[:len(chain)-1])
+		if err != nil {
+			conn.err = err
+			return
+		}
+
+		conn.err = conn.client.ConnectWith(conn.client.addr, prev.DialThrough)
+	})
+
+	return conn.client, conn.err
+}
+
+func (b *bastions) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, conn := range b.conns {
+		if conn.err == nil && conn.client != nil {
+			conn.client.Close()
+		}
+	}
+}
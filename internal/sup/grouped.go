@@ -0,0 +1,139 @@
+package sup
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// groupedOutput buffers the output of each host and prints it as one block
+// once the host finishes the task, similar to pssh -i. The tasks with
+// "stream" set are printed live, as by textOutput.
+type groupedOutput struct {
+	textOutput
+
+	mu     sync.Mutex
+	blocks map[groupKey]*outputBlock
+}
+
+// groupKey is the task on the client. Clients, not their hosts, tell
+// the blocks apart, as the hosts may share the address.
+type groupKey struct {
+	task *Task
+	c    Client
+}
+
+// outputBlock is the buffered output of the task on a single host.
+type outputBlock struct {
+	mu     sync.Mutex
+	name   string // Alias of the host.
+	stdout bytes.Buffer
+	stderr bytes.Buffer
+}
+
+func newGroupedOutput(text textOutput) *groupedOutput {
+	return &groupedOutput{
+		textOutput: text,
+		blocks:     map[groupKey]*outputBlock{},
+	}
+}
+
+func (o *groupedOutput) taskStart(task *Task, c Client) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.blocks[groupKey{task, c}] = &outputBlock{name: hostName(c)}
+}
+
+func (o *groupedOutput) copy(task *Task, c Client, stream string, r io.Reader) error {
+	if task.Stream {
+		return o.textOutput.copy(task, c, stream, r)
+	}
+
+	o.mu.Lock()
+	block, ok := o.blocks[groupKey{task, c}]
+	o.mu.Unlock()
+
+	if !ok {
+		// Not started by taskStart, print it as it comes.
+		return o.textOutput.copy(task, c, stream, r)
+	}
+
+	buf := &block.stdout
+	if stream == streamStderr {
+		buf = &block.stderr
+	}
+
+	chunk := make([]byte, 32*1024)
+
+	for {
+		n, err := r.Read(chunk)
+		if n > 0 {
+			block.mu.Lock()
+			buf.Write(chunk[:n])
+			block.mu.Unlock()
+		}
+
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// taskEnd prints the host's block: the header, STDOUT and STDERR.
+func (o *groupedOutput) taskEnd(task *Task, c Client, res *TaskResult) {
+	if res.Status == TaskSkipped {
+		return
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	key := groupKey{task, c}
+
+	block, ok := o.blocks[key]
+	if !ok {
+		// The task failed to start.
+		block = &outputBlock{name: hostName(c)}
+	}
+
+	delete(o.blocks, key)
+
+	host := res.Host
+	if block.name != res.Host {
+		host = fmt.Sprintf("%v (%v)", block.name, res.Host)
+	}
+
+	fmt.Fprintf(os.Stdout, "=== %v %v: %v, exit status %v, %v\n", host, res.Command, res.Status, res.ExitStatus, res.Duration.Round(time.Millisecond))
+
+	if res.Err != nil && res.Status != TaskOK {
+		fmt.Fprintf(os.Stdout, "error: %v\n", firstLine(res.Err))
+	}
+
+	writeBlock(os.Stdout, block.stdout.Bytes())
+
+	if block.stderr.Len() > 0 {
+		fmt.Fprintln(os.Stdout, "--- stderr")
+		writeBlock(os.Stdout, block.stderr.Bytes())
+	}
+}
+
+// writeBlock writes the output, terminating the last line.
+func writeBlock(w io.Writer, data []byte) {
+	if len(data) == 0 {
+		return
+	}
+
+	_, _ = w.Write(data)
+
+	if data[len(data)-1] != '\n' {
+		fmt.Fprintln(w)
+	}
+}
@@ -0,0 +1,160 @@
+package sup
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Host key checking modes.
+const (
+	HostKeyCheckStrict    = "strict"     // Reject unknown and changed host keys.
+	HostKeyCheckAcceptNew = "accept-new" // Trust and remember unknown host keys, reject changed ones.
+	HostKeyCheckOff       = "off"        // Don't verify host keys at all.
+)
+
+// ErrHostKey is returned when the remote host key is unknown or doesn't
+// match the one recorded in known_hosts.
+type ErrHostKey struct {
+	Host     string
+	Expected []string // Fingerprints of the recorded keys, empty for unknown host.
+	Received string   // Fingerprint of the key offered by the host.
+}
+
+func (e ErrHostKey) Error() string {
+	if len(e.Expected) == 0 {
+		return fmt.Sprintf("host key for %v is unknown (received %v)", e.Host, e.Received)
+	}
+
+	return fmt.Sprintf("host key mismatch for %v: expected %v, received %v", e.Host, strings.Join(e.Expected, " or "), e.Received)
+}
+
+// hostKeyChecker verifies host keys against a set of known_hosts files.
+type hostKeyChecker struct {
+	mu        sync.Mutex
+	files     []string
+	appendTo  string // File that new host keys are written to in accept-new mode.
+	acceptNew bool
+	db        ssh.HostKeyCallback
+}
+
+// NewHostKeyCallback returns ssh.HostKeyCallback verifying host keys
+// in the given mode against ~/.ssh/known_hosts and optional extra
+// knownHosts file. In accept-new mode, unknown keys are appended
+// to knownHosts, or to ~/.ssh/known_hosts if knownHosts is not set.
+func NewHostKeyCallback(mode, knownHosts string) (ssh.HostKeyCallback, error) {
+	switch mode {
+	case HostKeyCheckOff:
+		return ssh.InsecureIgnoreHostKey(), nil //nolint:gosec // Explicitly requested by the user.
+	case "", HostKeyCheckStrict, HostKeyCheckAcceptNew:
+	default:
+		return nil, fmt.Errorf("unknown host key check mode %q (expected %v, %v or %v)", mode, HostKeyCheckStrict, HostKeyCheckAcceptNew, HostKeyCheckOff)
+	}
+
+	c := &hostKeyChecker{
+		files:     []string{filepath.Join(os.Getenv("HOME"), ".ssh", "known_hosts")},
+		acceptNew: mode == HostKeyCheckAcceptNew,
+	}
+	c.appendTo = c.files[0]
+
+	if knownHosts != "" {
+		c.files = append(c.files, knownHosts)
+		c.appendTo = knownHosts
+	}
+
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+
+	return c.check, nil
+}
+
+// load (re)reads all the existing known_hosts files.
+func (c *hostKeyChecker) load() error {
+	var files []string
+
+	for _, file := range c.files {
+		if _, err := os.Stat(file); err == nil {
+			files = append(files, file)
+		}
+	}
+
+	c.db = nil
+
+	if len(files) == 0 {
+		return nil
+	}
+
+	db, err := knownhosts.New(files...)
+	if err != nil {
+		return errors.Join(err, errors.New("reading known_hosts failed"))
+	}
+
+	c.db = db
+
+	return nil
+}
+
+func (c *hostKeyChecker) check(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	keyErr := &knownhosts.KeyError{}
+
+	if c.db != nil {
+		err := c.db(hostname, remote, key)
+		if err == nil {
+			return nil
+		}
+
+		if !errors.As(err, &keyErr) {
+			return err
+		}
+	}
+
+	if len(keyErr.Want) > 0 {
+		expected := make([]string, len(keyErr.Want))
+		for i, want := range keyErr.Want {
+			expected[i] = fmt.Sprintf("%v (%v:%v)", ssh.FingerprintSHA256(want.Key), want.Filename, want.Line)
+		}
+
+		return ErrHostKey{hostname, expected, ssh.FingerprintSHA256(key)}
+	}
+
+	if !c.acceptNew {
+		return ErrHostKey{hostname, nil, ssh.FingerprintSHA256(key)}
+	}
+
+	if err := c.remember(hostname, key); err != nil {
+		return errors.Join(err, fmt.Errorf("adding host key for %v to %v failed", hostname, c.appendTo))
+	}
+
+	return c.load()
+}
+
+// remember appends the host key to the known_hosts file.
+func (c *hostKeyChecker) remember(hostname string, key ssh.PublicKey) error {
+	if err := os.MkdirAll(filepath.Dir(c.appendTo), 0o700); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(c.appendTo, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintln(f, knownhosts.Line([]string{hostname}, key))
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
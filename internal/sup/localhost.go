@@ -2,10 +2,12 @@ package sup
 
 import (
 	"errors"
+	"fmt"
 	"io"
 	"os"
 	"os/exec"
 	"os/user"
+	"syscall"
 
 	"github.com/DTreshy/sup/pkg/colors"
 )
@@ -19,6 +21,10 @@ type LocalhostClient struct {
 	stderr  io.Reader
 	running bool
 	env     string //export FOO="bar"; export BAR="baz";
+	name    string // Display alias of the host.
+	id      string // Unique name of the host in the run, see hostID.
+	group   bool   // The command runs in its own process group.
+	tunnels *tunnels
 }
 
 func (c *LocalhostClient) Connect(_ string) error {
@@ -39,11 +45,30 @@ func (c *LocalhostClient) Run(task *Task) error {
 		return errors.New("Command already running")
 	}
 
+	env := c.env
+
+	if len(task.Tunnels) > 0 {
+		// Local commands reach the network through task.Via.
+		tunnels, exports, err := openTunnels(remoteNetwork(task.Via), task.Tunnels)
+		if err != nil {
+			return ErrTask{task, err.Error()}
+		}
+
+		c.tunnels = tunnels
+		env += exports
+	}
+
 	cmdArgs := []string{
 		"-c",
-		c.env + task.Run,
+		env + task.Run,
 	}
 	cmd := exec.Command("bash", cmdArgs...)
+	// Own process group, so the signals reach the whole process tree.
+	// In a terminal, the command stays in sup's foreground group instead,
+	// so that its /dev/tty prompts (sudo, ssh, git) aren't stopped by
+	// SIGTTIN; Ctrl-C of the terminal reaches the whole group anyway.
+	c.group = !interactive()
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: c.group}
 	c.cmd = cmd
 
 	c.stdout, err = cmd.StdoutPipe()
@@ -62,6 +87,7 @@ func (c *LocalhostClient) Run(task *Task) error {
 	}
 
 	if err := c.cmd.Start(); err != nil {
+		c.tunnels.Close()
 		return ErrTask{task, err.Error()}
 	}
 
@@ -77,6 +103,8 @@ func (c *LocalhostClient) Wait() error {
 
 	err := c.cmd.Wait()
 	c.running = false
+	c.tunnels.Close()
+	c.tunnels = nil
 
 	return err
 }
@@ -97,8 +125,16 @@ func (c *LocalhostClient) Stdout() io.Reader {
 	return c.stdout
 }
 
+func (c *LocalhostClient) Host() string {
+	return "localhost"
+}
+
 func (c *LocalhostClient) Prefix() (prefix string, prefixLen int) {
 	host := c.user + "@localhost" + " | "
+	if c.name != "" {
+		host = c.name + " | "
+	}
+
 	return colors.ResetColor + host, len(host)
 }
 
@@ -110,8 +146,29 @@ func (c *LocalhostClient) WriteClose() error {
 	return c.stdin.Close()
 }
 
+// Signal sends the signal to the command's process group, if it has its own.
 func (c *LocalhostClient) Signal(sig os.Signal) error {
-	return c.cmd.Process.Signal(sig)
+	s, ok := sig.(syscall.Signal)
+	if !ok {
+		return fmt.Errorf("%v not supported", sig)
+	}
+
+	return syscall.Kill(c.pid(), s)
+}
+
+// Kill kills the command's process group, if it has its own.
+func (c *LocalhostClient) Kill() error {
+	return syscall.Kill(c.pid(), syscall.SIGKILL)
+}
+
+// pid returns the process ID of the command, or the negated ID of its
+// process group, which the signals are sent to.
+func (c *LocalhostClient) pid() int {
+	if c.group {
+		return -c.cmd.Process.Pid
+	}
+
+	return c.cmd.Process.Pid
 }
 
 func ResolveLocalPath(cwd, path, env string) (string, error) {
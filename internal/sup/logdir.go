@@ -0,0 +1,274 @@
+package sup
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// manifestFile is the name of the run's manifest in the run's log directory.
+const manifestFile = "manifest.json"
+
+// LogDir sets the directory each run writes the hosts' output to,
+// see logOutput. Empty dir disables the logs.
+func (sup *Stackup) LogDir(dir string) {
+	sup.logDir = dir
+}
+
+// logOutput writes the commands' output to DIR/<run-id>/<host>/<command>.log
+// files and the run's manifest, in addition to the console output.
+type logOutput struct {
+	output // The console output.
+
+	dir   string // The run's log directory.
+	runID string
+
+	mu    sync.Mutex
+	files map[string]*logFile // By the file's path relative to dir.
+	logs  map[string]string   // File paths by the command and the host.
+
+	network  string
+	commands []string
+	names    map[string]string // Host aliases.
+	started  time.Time
+}
+
+// newLogOutput creates new log directory of the run in dir.
+func newLogOutput(dir string, console output) (*logOutput, error) {
+	started := time.Now()
+	runID := started.UTC().Format("20060102T150405Z")
+
+	// Don't mix the logs of the runs started within the same second.
+	runDir := filepath.Join(dir, runID)
+	for i := 2; ; i++ {
+		err := os.MkdirAll(dir, 0o755)
+		if err == nil {
+			err = os.Mkdir(runDir, 0o755)
+		}
+
+		if err == nil {
+			break
+		}
+
+		if !os.IsExist(err) {
+			return nil, errors.Join(err, errors.New("creating log directory failed"))
+		}
+
+		runDir = filepath.Join(dir, fmt.Sprintf("%v-%v", runID, i))
+	}
+
+	return &logOutput{
+		output:  console,
+		dir:     runDir,
+		runID:   filepath.Base(runDir),
+		files:   map[string]*logFile{},
+		logs:    map[string]string{},
+		names:   map[string]string{},
+		started: started,
+	}, nil
+}
+
+func (o *logOutput) runStart(network string, hosts, commands []string) {
+	o.network = network
+	o.commands = commands
+
+	o.output.runStart(network, hosts, commands)
+}
+
+func (o *logOutput) hostConnected(c Client) {
+	o.mu.Lock()
+	o.names[hostID(c)] = hostName(c)
+	o.mu.Unlock()
+
+	o.output.hostConnected(c)
+}
+
+// copy copies the stream to the console and the client's log file.
+func (o *logOutput) copy(task *Task, c Client, stream string, r io.Reader) error {
+	file, err := o.open(task, c)
+	if err != nil {
+		o.output.warn(c, err, "opening log file failed")
+		return o.output.copy(task, c, stream, r)
+	}
+
+	w := &lineWriter{file: file}
+	defer w.Flush()
+
+	return o.output.copy(task, c, stream, io.TeeReader(r, w))
+}
+
+// open returns the log file of the command on the client's host.
+// All the tasks of the command append to the same file.
+func (o *logOutput) open(task *Task, c Client) (*logFile, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	path := filepath.Join(logFileName(hostName(c)), logFileName(task.Name)+".log")
+	o.logs[task.Name+"\x00"+hostID(c)] = path
+
+	if file, ok := o.files[path]; ok {
+		return file, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(filepath.Join(o.dir, path)), 0o755); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(filepath.Join(o.dir, path), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	o.files[path] = &logFile{f: f}
+
+	return o.files[path], nil
+}
+
+func (o *logOutput) runEnd(report *RunReport, err error) {
+	o.output.runEnd(report, err)
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for _, file := range o.files {
+		file.f.Close()
+	}
+
+	if err := o.writeManifest(report, err); err != nil {
+		o.output.warn(nil, err, "writing log manifest failed")
+		return
+	}
+
+	o.output.notice(nil, "Logs written to "+o.dir)
+}
+
+// manifest describes the run, written along with the logs.
+type manifest struct {
+	RunID      string         `json:"run_id"`
+	Network    string         `json:"network"`
+	Commands   []string       `json:"commands"`
+	Hosts      []manifestHost `json:"hosts"`
+	Tasks      []manifestTask `json:"tasks"`
+	Started    time.Time      `json:"started"`
+	Finished   time.Time      `json:"finished"`
+	DurationMs int64          `json:"duration_ms"`
+	ExitStatus int            `json:"exit_status"`
+	Error      string         `json:"error,omitempty"`
+}
+
+type manifestHost struct {
+	Host   string `json:"host"`
+	Name   string `json:"name,omitempty"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type manifestTask struct {
+	Command    string `json:"command"`
+	Host       string `json:"host"`
+	Status     string `json:"status"`
+	ExitStatus int    `json:"exit_status"`
+	DurationMs int64  `json:"duration_ms"`
+	Error      string `json:"error,omitempty"`
+	Log        string `json:"log,omitempty"` // Relative to the manifest.
+}
+
+func (o *logOutput) writeManifest(report *RunReport, err error) error {
+	m := manifest{
+		RunID:      o.runID,
+		Network:    o.network,
+		Commands:   o.commands,
+		Started:    o.started,
+		Finished:   o.started.Add(report.Duration),
+		DurationMs: report.Duration.Milliseconds(),
+		ExitStatus: runExitStatus(report, err),
+		Error:      errorString(err),
+	}
+
+	for _, host := range report.Summary() {
+		m.Hosts = append(m.Hosts, manifestHost{
+			Host:   host.Host,
+			Name:   o.names[host.Host],
+			Status: string(host.Status),
+			Error:  host.Error,
+		})
+	}
+
+	for _, res := range report.Results {
+		m.Tasks = append(m.Tasks, manifestTask{
+			Command:    res.Command,
+			Host:       res.Host,
+			Status:     string(res.Status),
+			ExitStatus: res.ExitStatus,
+			DurationMs: res.Duration.Milliseconds(),
+			Error:      errorString(res.Err),
+			Log:        o.logs[res.Command+"\x00"+res.Host],
+		})
+	}
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Join(o.dir, manifestFile), append(data, '\n'), 0o644)
+}
+
+// logFile is shared by the STDOUT and STDERR of the command.
+type logFile struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+// lineWriter writes whole lines to the log file, so that the lines
+// of STDOUT and STDERR don't get mixed.
+type lineWriter struct {
+	file *logFile
+	buf  []byte
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+
+	if i := bytes.LastIndexByte(w.buf, '\n'); i >= 0 {
+		w.write(w.buf[:i+1])
+		w.buf = append(w.buf[:0], w.buf[i+1:]...)
+	}
+
+	return len(p), nil
+}
+
+// Flush writes the last unterminated line.
+func (w *lineWriter) Flush() {
+	if len(w.buf) > 0 {
+		w.write(append(w.buf, '\n'))
+		w.buf = nil
+	}
+}
+
+// write ignores the errors, failing to log doesn't fail the command.
+func (w *lineWriter) write(p []byte) {
+	w.file.mu.Lock()
+	defer w.file.mu.Unlock()
+
+	_, _ = w.file.f.Write(p)
+}
+
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9._@:-]+`)
+
+// logFileName makes the host or command name safe to be used as a file name.
+func logFileName(name string) string {
+	name = unsafeFileChars.ReplaceAllString(name, "_")
+	if name == "" || name == "." || name == ".." {
+		name = "_" + name
+	}
+
+	return name
+}
@@ -0,0 +1,891 @@
+package sup
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// Connection multiplexing, similar to OpenSSH ControlMaster/ControlPersist.
+//
+// A background sup process (the master) listens on a control socket and
+// keeps the SSH connections to the hosts alive. Every sup run talks SSH
+// to the master over the socket: it asks the master to connect to a host
+// and then opens sessions as usual, which the master forwards over the
+// host connection. The master authenticates to the hosts with the keys
+// of the sup run that asked for the connection first, through an agent
+// channel forwarded over the control socket. Host connections are closed
+// once unused for the persist period; the master exits when there are
+// none left.
+
+// MuxServeArg is the first argument of the background master process.
+const MuxServeArg = "--mux-serve"
+
+const (
+	// muxConnectRequest asks the master to connect to the host in the payload.
+	muxConnectRequest = "connect@sup"
+
+	// muxAgentChannel is opened by the master to authenticate to the hosts
+	// with the keys of the sup run. Unlike the forwarded ssh-agent channels,
+	// it serves the keys sup itself would offer.
+	muxAgentChannel = "auth-agent@sup"
+
+	agentChannel = "auth-agent@openssh.com"
+	agentRequest = "auth-agent-req@openssh.com"
+)
+
+// muxConfig is the control socket of the master process.
+type muxConfig struct {
+	socket       string
+	persist      time.Duration
+	hostKeyCheck string
+	knownHosts   string
+
+	startOnce sync.Once
+	startErr  error
+}
+
+// muxRequest is the payload of the connect request.
+type muxRequest struct {
+	Addr         string        // user@host:port
+	Jumps        []string      // user@host:port of the jump hosts, in order
+	HostKeyCheck string        // Host key checking mode.
+	KnownHosts   string        // Extra known_hosts file.
+	Persist      time.Duration // How long to keep the unused connection.
+
+	ConnectTimeout      time.Duration
+	ConnectRetries      int
+	RetryBackoff        time.Duration
+	ServerAliveInterval time.Duration
+	ServerAliveCountMax int
+}
+
+func newMuxConfig(socket string, persist time.Duration, hostKeyCheck, knownHosts string) *muxConfig {
+	return &muxConfig{
+		socket:       socket,
+		persist:      persist,
+		hostKeyCheck: hostKeyCheck,
+		knownHosts:   knownHosts,
+	}
+}
+
+// dial connects to the control socket, starting the master if needed.
+func (m *muxConfig) dial() (net.Conn, error) {
+	conn, err := net.Dial("unix", m.socket)
+	if err == nil {
+		return conn, nil
+	}
+
+	m.startOnce.Do(func() {
+		m.startErr = m.start()
+	})
+
+	if m.startErr != nil {
+		return nil, m.startErr
+	}
+
+	// Wait for the master to start listening.
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		conn, err = net.Dial("unix", m.socket)
+		if err == nil {
+			return conn, nil
+		}
+	}
+
+	return nil, errors.Join(err, fmt.Errorf("control socket %v is not available", m.socket))
+}
+
+// start starts the master process in the background.
+func (m *muxConfig) start() error {
+	if err := os.MkdirAll(filepath.Dir(m.socket), 0o700); err != nil {
+		return errors.Join(err, errors.New("creating control socket directory failed"))
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return errors.Join(err, errors.New("starting control master failed"))
+	}
+
+	cmd := exec.Command(exe, MuxServeArg, m.socket, m.persist.String())
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true} // Outlive the terminal session.
+
+	if err := cmd.Start(); err != nil {
+		return errors.Join(err, errors.New("starting control master failed"))
+	}
+
+	return cmd.Process.Release()
+}
+
+// connectMux connects to the host through the control master, optionally
+// through the jump hosts. Keys of both the client and the jump host clients
+// are available to the master, in case it needs to open the connections.
+func (c *SSHClient) connectMux(host string, hops []*SSHClient, mux *muxConfig) error {
+	if c.connOpened {
+		return errors.New("already connected")
+	}
+
+	err := c.parseHost(host)
+	if err != nil {
+		return err
+	}
+
+	signers, identities, err := c.signers()
+	if err != nil {
+		return ErrConnect{User: c.user, Host: c.host, Reason: err.Error()}
+	}
+
+	req := muxRequest{
+		Addr:         c.user + "@" + c.host,
+		HostKeyCheck: mux.hostKeyCheck,
+		KnownHosts:   mux.knownHosts,
+		Persist:      mux.persist,
+
+		ConnectTimeout:      c.connectTimeout,
+		ConnectRetries:      c.connectRetries,
+		RetryBackoff:        c.retryBackoff,
+		ServerAliveInterval: c.serverAliveInterval,
+		ServerAliveCountMax: c.serverAliveCountMax,
+	}
+
+	for _, hop := range hops {
+		req.Jumps = append(req.Jumps, hop.user+"@"+hop.host)
+
+		if hopSigners, _, err := hop.signers(); err == nil {
+			signers = append(signers, hopSigners...)
+		}
+	}
+
+	sock, err := mux.dial()
+	if err != nil {
+		return ErrConnect{User: c.user, Host: c.host, Reason: err.Error()}
+	}
+
+	conn, chans, reqs, err := ssh.NewClientConn(sock, mux.socket, &ssh.ClientConfig{
+		User:            c.user,
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(), //nolint:gosec // The socket is accessible by the user only.
+	})
+	if err != nil {
+		sock.Close()
+		return ErrConnect{User: c.user, Host: c.host, Reason: fmt.Sprintf("control socket %v: %v", mux.socket, err)}
+	}
+
+	client := ssh.NewClient(conn, chans, reqs)
+
+	if err := serveMuxAgent(client, signersAgent(signers)); err != nil {
+		client.Close()
+		return ErrConnect{User: c.user, Host: c.host, Reason: err.Error()}
+	}
+
+	payload, err := json.Marshal(req)
+	if err != nil {
+		client.Close()
+		return ErrConnect{User: c.user, Host: c.host, Reason: err.Error()}
+	}
+
+	ok, reply, err := client.SendRequest(muxConnectRequest, true, payload)
+	if err != nil {
+		client.Close()
+		return ErrConnect{User: c.user, Host: c.host, Reason: fmt.Sprintf("control socket %v: %v", mux.socket, err)}
+	}
+
+	if !ok {
+		client.Close()
+
+		reason := string(reply)
+		if strings.Contains(reason, "unable to authenticate") {
+			reason = fmt.Sprintf("%v (offered identities: %v)", reason, strings.Join(identities, ", "))
+		}
+
+		return ErrConnect{User: c.user, Host: c.host, Reason: reason}
+	}
+
+	c.conn = client
+	c.connOpened = true
+
+	// Keepalives are forwarded to the host by the master.
+	if c.serverAliveInterval > 0 {
+		go c.keepalive(c.conn)
+	}
+
+	return nil
+}
+
+// ServeMux runs the control master on the socket. It returns once there
+// were no connections for the persist period.
+func ServeMux(socket string, persist time.Duration) error {
+	// Don't replace the running master.
+	if conn, err := net.Dial("unix", socket); err == nil {
+		conn.Close()
+		return nil
+	}
+
+	os.Remove(socket)
+
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(socket)
+
+	if err := os.Chmod(socket, 0o600); err != nil {
+		listener.Close()
+		return err
+	}
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		listener.Close()
+		return err
+	}
+
+	hostKey, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		listener.Close()
+		return err
+	}
+
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(hostKey)
+
+	m := &mux{
+		listener:  listener,
+		persist:   persist,
+		upstreams: map[string]*upstream{},
+	}
+
+	m.mu.Lock()
+	m.checkExit()
+	m.mu.Unlock()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			m.mu.Lock()
+			exited := m.exited
+			m.mu.Unlock()
+
+			if exited {
+				return nil
+			}
+
+			return err
+		}
+
+		go m.serve(conn, config)
+	}
+}
+
+// mux is the control master state.
+type mux struct {
+	mu        sync.Mutex
+	listener  net.Listener
+	persist   time.Duration
+	conns     int                  // Number of connected sup runs.
+	upstreams map[string]*upstream // Host connections by the connect request.
+	exit      *time.Timer
+	exited    bool
+}
+
+// upstream is a host connection shared by the sup runs.
+type upstream struct {
+	key     string
+	client  *SSHClient
+	bastion *upstream
+	refs    int
+	persist time.Duration
+	idle    *time.Timer
+	ready   chan struct{} // Closed once connected, or failed to.
+	err     error
+	agent   ssh.Conn // Sup run serving the forwarded ssh-agent.
+}
+
+// checkExit schedules the master exit, if there's nothing to serve.
+// It must be called with the lock held.
+func (m *mux) checkExit() {
+	if m.exit != nil {
+		m.exit.Stop()
+		m.exit = nil
+	}
+
+	if m.conns > 0 || len(m.upstreams) > 0 {
+		return
+	}
+
+	m.exit = time.AfterFunc(m.persist, func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		if m.conns == 0 && len(m.upstreams) == 0 {
+			m.exited = true
+			m.listener.Close()
+		}
+	})
+}
+
+// serve serves single sup run connection.
+func (m *mux) serve(sock net.Conn, config *ssh.ServerConfig) {
+	m.mu.Lock()
+	m.conns++
+	m.checkExit()
+	m.mu.Unlock()
+
+	defer func() {
+		m.mu.Lock()
+		m.conns--
+		m.checkExit()
+		m.mu.Unlock()
+	}()
+
+	conn, chans, reqs, err := ssh.NewServerConn(sock, config)
+	if err != nil {
+		sock.Close()
+		return
+	}
+	defer conn.Close()
+
+	var up *upstream
+
+	// Remote forwardings of the sup run, by the bound address.
+	forwards := map[string]net.Listener{}
+
+	for req := range reqs {
+		if req.Type != muxConnectRequest {
+			if up == nil {
+				_ = req.Reply(false, nil)
+				continue
+			}
+
+			switch req.Type {
+			case "tcpip-forward":
+				forwardRemote(up.client.conn, conn, req, forwards)
+				continue
+			case "cancel-tcpip-forward":
+				cancelRemote(req, forwards)
+				continue
+			}
+
+			// Ie. keepalives, check the host connection.
+			ok, payload, err := up.client.conn.SendRequest(req.Type, req.WantReply, req.Payload)
+			if req.WantReply {
+				_ = req.Reply(ok && err == nil, payload)
+			}
+
+			continue
+		}
+
+		if up != nil {
+			_ = req.Reply(false, []byte("already connected"))
+			continue
+		}
+
+		var r muxRequest
+		if err := json.Unmarshal(req.Payload, &r); err != nil {
+			_ = req.Reply(false, []byte(err.Error()))
+			continue
+		}
+
+		up, err = m.acquire(r, conn)
+		if err != nil {
+			var connErr ErrConnect
+			if errors.As(err, &connErr) {
+				err = errors.New(connErr.reason())
+			}
+
+			_ = req.Reply(false, []byte(err.Error()))
+
+			continue
+		}
+
+		_ = req.Reply(true, nil)
+
+		go func(up *upstream) {
+			for ch := range chans {
+				go proxyChannel(ch, up.client.conn, func(req *ssh.Request) {
+					if req.Type == agentRequest {
+						m.setAgent(up, conn)
+					}
+				})
+			}
+		}(up)
+	}
+
+	for _, listener := range forwards {
+		listener.Close()
+	}
+
+	if up != nil {
+		m.unsetAgent(up, conn)
+		m.release(up)
+	}
+}
+
+// forwardMsg is the payload of the tcpip-forward and cancel-tcpip-forward
+// requests (RFC 4254, section 7.1).
+type forwardMsg struct {
+	Addr string
+	Port uint32
+}
+
+// forwardRemote listens on the host for the sup run and forwards
+// the accepted connections back to it as forwarded-tcpip channels.
+func forwardRemote(host *ssh.Client, conn ssh.Conn, req *ssh.Request, forwards map[string]net.Listener) {
+	var msg forwardMsg
+	if err := ssh.Unmarshal(req.Payload, &msg); err != nil {
+		_ = req.Reply(false, nil)
+		return
+	}
+
+	listener, err := host.Listen("tcp", net.JoinHostPort(msg.Addr, fmt.Sprint(msg.Port)))
+	if err != nil {
+		_ = req.Reply(false, nil)
+		return
+	}
+
+	port := uint32(listener.Addr().(*net.TCPAddr).Port)
+	forwards[net.JoinHostPort(msg.Addr, fmt.Sprint(port))] = listener
+
+	var reply []byte
+	if msg.Port == 0 {
+		reply = ssh.Marshal(struct{ Port uint32 }{port})
+	}
+
+	_ = req.Reply(true, reply)
+
+	go func() {
+		for {
+			remote, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer remote.Close()
+
+				origin, _ := remote.RemoteAddr().(*net.TCPAddr)
+				if origin == nil {
+					origin = &net.TCPAddr{}
+				}
+
+				payload := ssh.Marshal(struct {
+					Addr       string
+					Port       uint32
+					OriginAddr string
+					OriginPort uint32
+				}{msg.Addr, port, origin.IP.String(), uint32(origin.Port)})
+
+				ch, reqs, err := conn.OpenChannel("forwarded-tcpip", payload)
+				if err != nil {
+					return
+				}
+				defer ch.Close()
+
+				go ssh.DiscardRequests(reqs)
+
+				go func() {
+					_, _ = io.Copy(ch, remote)
+					_ = ch.CloseWrite()
+				}()
+
+				_, _ = io.Copy(remote, ch)
+			}()
+		}
+	}()
+}
+
+// cancelRemote stops the remote forwarding of the sup run.
+func cancelRemote(req *ssh.Request, forwards map[string]net.Listener) {
+	var msg forwardMsg
+	if err := ssh.Unmarshal(req.Payload, &msg); err != nil {
+		_ = req.Reply(false, nil)
+		return
+	}
+
+	key := net.JoinHostPort(msg.Addr, fmt.Sprint(msg.Port))
+
+	listener, ok := forwards[key]
+	if ok {
+		listener.Close()
+		delete(forwards, key)
+	}
+
+	_ = req.Reply(ok, nil)
+}
+
+// setAgent makes the sup run serve the ssh-agent forwarded to the host.
+// The last sup run requesting agent forwarding wins.
+func (m *mux) setAgent(up *upstream, conn ssh.Conn) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	up.agent = conn
+}
+
+// unsetAgent stops forwarding ssh-agent to the sup run, if it serves it.
+func (m *mux) unsetAgent(up *upstream, conn ssh.Conn) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if up.agent == conn {
+		up.agent = nil
+	}
+}
+
+// acquire returns the host connection, connecting to the host if needed.
+// Keys are requested from the sup run over the agent channel.
+func (m *mux) acquire(r muxRequest, conn ssh.Conn) (*upstream, error) {
+	key := fmt.Sprintf("%v via %v (%v %v)", r.Addr, strings.Join(r.Jumps, ","), r.HostKeyCheck, r.KnownHosts)
+
+	for {
+		m.mu.Lock()
+
+		up, ok := m.upstreams[key]
+		if !ok {
+			break
+		}
+
+		up.refs++
+		up.persist = r.Persist
+
+		if up.idle != nil {
+			up.idle.Stop()
+			up.idle = nil
+		}
+
+		m.mu.Unlock()
+
+		<-up.ready
+
+		if up.err != nil {
+			return nil, up.err
+		}
+
+		// Make sure the connection is still alive.
+		if _, _, err := up.client.conn.SendRequest("keepalive@openssh.com", true, nil); err == nil {
+			return up, nil
+		}
+
+		// Drop the stale connection, the first one to notice closes it.
+		m.mu.Lock()
+		up.refs--
+		unused := up.refs == 0
+
+		stale := m.upstreams[key] == up
+		if stale {
+			delete(m.upstreams, key)
+		}
+		m.mu.Unlock()
+
+		if stale {
+			up.client.Close()
+		}
+
+		if unused && up.bastion != nil {
+			m.release(up.bastion)
+		}
+	}
+
+	up := &upstream{
+		key:     key,
+		refs:    1,
+		persist: r.Persist,
+		ready:   make(chan struct{}),
+	}
+	m.upstreams[key] = up
+	m.checkExit()
+	m.mu.Unlock()
+
+	up.err = m.dial(up, r, conn)
+	close(up.ready)
+
+	if up.err != nil {
+		m.mu.Lock()
+		if m.upstreams[key] == up {
+			delete(m.upstreams, key)
+		}
+		m.checkExit()
+		m.mu.Unlock()
+
+		return nil, up.err
+	}
+
+	// Forward the host's ssh-agent channels to the sup run serving the agent.
+	agentChans := up.client.conn.HandleChannelOpen(agentChannel)
+
+	go func() {
+		for ch := range agentChans {
+			m.mu.Lock()
+			target := up.agent
+			m.mu.Unlock()
+
+			if target == nil {
+				_ = ch.Reject(ssh.Prohibited, "agent forwarding is not enabled")
+				continue
+			}
+
+			go proxyChannel(ch, target, nil)
+		}
+	}()
+
+	// Forget the connection once it's closed by the host.
+	go func() {
+		_ = up.client.conn.Wait()
+
+		m.mu.Lock()
+		if m.upstreams[key] == up {
+			delete(m.upstreams, key)
+		}
+		m.checkExit()
+		m.mu.Unlock()
+	}()
+
+	return up, nil
+}
+
+// dial connects to the host of the upstream.
+func (m *mux) dial(up *upstream, r muxRequest, conn ssh.Conn) error {
+	ch, reqs, err := conn.OpenChannel(muxAgentChannel, nil)
+	if err != nil {
+		return errors.Join(err, errors.New("opening agent channel failed"))
+	}
+	defer ch.Close()
+
+	go ssh.DiscardRequests(reqs)
+
+	hostKeyCallback, err := NewHostKeyCallback(r.HostKeyCheck, r.KnownHosts)
+	if err != nil {
+		return err
+	}
+
+	up.client = &SSHClient{
+		hostKeyCallback: hostKeyCallback,
+		auth:            []ssh.AuthMethod{ssh.PublicKeysCallback(agent.NewClient(ch).Signers)},
+
+		connectTimeout:      r.ConnectTimeout,
+		connectRetries:      r.ConnectRetries,
+		retryBackoff:        r.RetryBackoff,
+		serverAliveInterval: r.ServerAliveInterval,
+		serverAliveCountMax: r.ServerAliveCountMax,
+	}
+
+	if len(r.Jumps) == 0 {
+		return up.client.Connect(r.Addr)
+	}
+
+	// The last hop is reached through the preceding ones.
+	hop := r
+	hop.Addr = r.Jumps[len(r.Jumps)-1]
+	hop.Jumps = r.Jumps[:len(r.Jumps)-1]
+
+	up.bastion, err = m.acquire(hop, conn)
+	if err != nil {
+		return errors.Join(err, errors.New("connecting to bastion failed"))
+	}
+
+	if err := up.client.ConnectWith(r.Addr, up.bastion.client.DialThrough); err != nil {
+		m.release(up.bastion)
+		return err
+	}
+
+	return nil
+}
+
+// release drops the reference to the host connection. Unused connection
+// is closed after the persist period.
+func (m *mux) release(up *upstream) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	up.refs--
+	if up.refs > 0 {
+		return
+	}
+
+	up.idle = time.AfterFunc(up.persist, func() {
+		m.mu.Lock()
+
+		if up.refs > 0 || m.upstreams[up.key] != up {
+			m.mu.Unlock()
+			return
+		}
+
+		delete(m.upstreams, up.key)
+		m.checkExit()
+		m.mu.Unlock()
+
+		up.client.Close()
+
+		if up.bastion != nil {
+			m.release(up.bastion)
+		}
+	})
+}
+
+// proxyChannel forwards the channel to the other side, ie. the session
+// opened by a sup run to the host. The onRequest callback, if set, is called
+// for each request sent by the channel opener.
+func proxyChannel(ch ssh.NewChannel, upstream ssh.Conn, onRequest func(*ssh.Request)) {
+	remote, remoteReqs, err := upstream.OpenChannel(ch.ChannelType(), ch.ExtraData())
+	if err != nil {
+		var openErr *ssh.OpenChannelError
+		if errors.As(err, &openErr) {
+			_ = ch.Reject(openErr.Reason, openErr.Message)
+		} else {
+			_ = ch.Reject(ssh.ConnectionFailed, err.Error())
+		}
+
+		return
+	}
+
+	local, localReqs, err := ch.Accept()
+	if err != nil {
+		remote.Close()
+		return
+	}
+
+	var output sync.WaitGroup
+
+	output.Add(2)
+
+	go func() {
+		_, _ = io.Copy(remote, local)
+		_ = remote.CloseWrite()
+	}()
+
+	go func() {
+		defer output.Done()
+
+		_, _ = io.Copy(local, remote)
+	}()
+
+	go func() {
+		defer output.Done()
+
+		_, _ = io.Copy(local.Stderr(), remote.Stderr())
+	}()
+
+	// Requests of the sup run, ie. pty-req, exec or signal.
+	go func() {
+		for req := range localReqs {
+			if onRequest != nil {
+				onRequest(req)
+			}
+
+			ok, err := remote.SendRequest(req.Type, req.WantReply, req.Payload)
+			if req.WantReply {
+				_ = req.Reply(ok && err == nil, nil)
+			}
+		}
+
+		remote.Close()
+	}()
+
+	// Requests of the host, ie. exit-status. The channel is closed
+	// once the host closes it and all its output is forwarded.
+	for req := range remoteReqs {
+		ok, err := local.SendRequest(req.Type, req.WantReply, req.Payload)
+		if req.WantReply {
+			_ = req.Reply(ok && err == nil, nil)
+		}
+	}
+
+	output.Wait()
+
+	_ = local.CloseWrite()
+	local.Close()
+}
+
+// serveMuxAgent serves the keyring on the muxAgentChannel channels,
+// opened by the master.
+func serveMuxAgent(client *ssh.Client, keyring agent.Agent) error {
+	chans := client.HandleChannelOpen(muxAgentChannel)
+	if chans == nil {
+		return fmt.Errorf("%v channels are served already", muxAgentChannel)
+	}
+
+	go func() {
+		for ch := range chans {
+			channel, reqs, err := ch.Accept()
+			if err != nil {
+				continue
+			}
+
+			go ssh.DiscardRequests(reqs)
+
+			go func() {
+				_ = agent.ServeAgent(keyring, channel)
+				channel.Close()
+			}()
+		}
+	}()
+
+	return nil
+}
+
+// signersAgent serves the identities of the sup run to the master.
+type signersAgent []ssh.Signer
+
+func (a signersAgent) List() ([]*agent.Key, error) {
+	keys := make([]*agent.Key, 0, len(a))
+
+	for _, signer := range a {
+		pub := signer.PublicKey()
+		keys = append(keys, &agent.Key{Format: pub.Type(), Blob: pub.Marshal()})
+	}
+
+	return keys, nil
+}
+
+func (a signersAgent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	return a.SignWithFlags(key, data, 0)
+}
+
+func (a signersAgent) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	for _, signer := range a {
+		if string(signer.PublicKey().Marshal()) != string(key.Marshal()) {
+			continue
+		}
+
+		algSigner, ok := signer.(ssh.AlgorithmSigner)
+
+		switch {
+		case ok && flags&agent.SignatureFlagRsaSha256 != 0:
+			return algSigner.SignWithAlgorithm(rand.Reader, data, ssh.KeyAlgoRSASHA256)
+		case ok && flags&agent.SignatureFlagRsaSha512 != 0:
+			return algSigner.SignWithAlgorithm(rand.Reader, data, ssh.KeyAlgoRSASHA512)
+		default:
+			return signer.Sign(rand.Reader, data)
+		}
+	}
+
+	return nil, errors.New("unknown key")
+}
+
+func (a signersAgent) Signers() ([]ssh.Signer, error) {
+	return a, nil
+}
+
+func (a signersAgent) Extension(string, []byte) ([]byte, error) {
+	return nil, agent.ErrExtensionUnsupported
+}
+
+var errReadOnlyAgent = errors.New("sup agent is read-only")
+
+func (a signersAgent) Add(agent.AddedKey) error   { return errReadOnlyAgent }
+func (a signersAgent) Remove(ssh.PublicKey) error { return errReadOnlyAgent }
+func (a signersAgent) RemoveAll() error           { return errReadOnlyAgent }
+func (a signersAgent) Lock([]byte) error          { return errReadOnlyAgent }
+func (a signersAgent) Unlock([]byte) error        { return errReadOnlyAgent }
@@ -0,0 +1,290 @@
+package sup
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Output formats, see Stackup.Output.
+const (
+	OutputText      = "text"
+	OutputJSON      = "json"
+	OutputGrouped   = "grouped"
+	OutputAggregate = "aggregate"
+)
+
+// Streams of the commands' output.
+const (
+	streamStdout = "stdout"
+	streamStderr = "stderr"
+)
+
+// output presents the progress of the run and the output of the commands.
+type output interface {
+	runStart(network string, hosts, commands []string)
+	hostConnected(c Client)
+	hostFailed(host string, err error)
+	taskStart(task *Task, c Client)
+	// copy copies the client's stream until EOF.
+	copy(task *Task, c Client, stream string, r io.Reader) error
+	taskEnd(task *Task, c Client, res *TaskResult)
+	// notice informs about the run, or the client if not nil.
+	notice(c Client, msg string)
+	// warn prints the error, followed by the message if not empty.
+	warn(c Client, err error, msg string)
+	runEnd(report *RunReport, err error)
+}
+
+// Output sets the format of the output: "text" (prefixed lines, default),
+// "json" (one event per line), "grouped" (block of output per host) or
+// "aggregate" (block per distinct output).
+func (sup *Stackup) Output(format string) error {
+	switch format {
+	case OutputText, "":
+		sup.out = textOutput{sup: sup}
+	case OutputJSON:
+		sup.out = newJSONOutput(os.Stdout)
+	case OutputGrouped:
+		sup.out = newGroupedOutput(textOutput{sup: sup})
+	case OutputAggregate:
+		sup.out = newAggregateOutput(textOutput{sup: sup})
+	default:
+		return fmt.Errorf("unknown output format %q, expected %v, %v, %v or %v", format, OutputText, OutputJSON, OutputGrouped, OutputAggregate)
+	}
+
+	return nil
+}
+
+// textOutput prints the commands' output prefixed by the host and
+// the progress to STDERR.
+type textOutput struct {
+	sup *Stackup
+}
+
+func (textOutput) runStart(string, []string, []string) {}
+
+func (textOutput) hostConnected(Client) {}
+
+func (textOutput) hostFailed(_ string, err error) {
+	fmt.Fprintln(os.Stderr, err)
+}
+
+func (textOutput) taskStart(*Task, Client) {}
+
+func (o textOutput) copy(task *Task, c Client, stream string, r io.Reader) error {
+	var w io.Writer = os.Stdout
+	if stream == streamStderr {
+		w = os.Stderr
+	}
+
+	return copyPrefixed(w, r, func() string { return o.sup.prefixOf(c, task) })
+}
+
+func (textOutput) taskEnd(*Task, Client, *TaskResult) {}
+
+func (o textOutput) notice(c Client, msg string) {
+	fmt.Fprintln(os.Stderr, o.sup.prefixOf(c, nil)+msg)
+}
+
+func (o textOutput) warn(c Client, err error, msg string) {
+	if msg == "" {
+		fmt.Fprintf(os.Stderr, "%s%v\n", o.sup.prefixOf(c, nil), err)
+		return
+	}
+
+	fmt.Fprintln(os.Stderr, errors.Join(err, errors.New(o.sup.prefixOf(c, nil)+msg)))
+}
+
+func (textOutput) runEnd(report *RunReport, _ error) {
+	fmt.Fprintln(os.Stderr)
+	report.PrintSummary(os.Stderr)
+}
+
+// jsonOutput writes NDJSON events, see the README for their fields.
+type jsonOutput struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func newJSONOutput(w io.Writer) *jsonOutput {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+
+	return &jsonOutput{enc: enc}
+}
+
+// event is the common part of all the events.
+type event struct {
+	Time  time.Time `json:"time"`
+	Event string    `json:"event"`
+}
+
+func newEvent(name string) event {
+	return event{Time: time.Now(), Event: name}
+}
+
+type hostSummaryEvent struct {
+	Host       string `json:"host"`
+	Status     string `json:"status"`
+	OK         int    `json:"ok"`
+	Failed     int    `json:"failed"`
+	Ignored    int    `json:"ignored"`
+	Skipped    int    `json:"skipped"`
+	DurationMs int64  `json:"duration_ms"`
+	Error      string `json:"error,omitempty"`
+}
+
+func (o *jsonOutput) emit(v any) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if err := o.enc.Encode(v); err != nil {
+		fmt.Fprintln(os.Stderr, errors.Join(err, errors.New("writing event failed")))
+	}
+}
+
+func (o *jsonOutput) runStart(network string, hosts, commands []string) {
+	o.emit(struct {
+		event
+		Network  string   `json:"network"`
+		Hosts    []string `json:"hosts"`
+		Commands []string `json:"commands"`
+	}{newEvent("run_start"), network, hosts, commands})
+}
+
+func (o *jsonOutput) hostConnected(c Client) {
+	o.emit(struct {
+		event
+		Host string `json:"host"`
+		Name string `json:"name"`
+	}{newEvent("host_connected"), hostID(c), hostName(c)})
+}
+
+func (o *jsonOutput) hostFailed(host string, err error) {
+	o.emit(struct {
+		event
+		Host  string `json:"host"`
+		Error string `json:"error"`
+	}{newEvent("host_failed"), host, err.Error()})
+}
+
+func (o *jsonOutput) taskStart(task *Task, c Client) {
+	o.emit(struct {
+		event
+		Host    string `json:"host"`
+		Command string `json:"command"`
+	}{newEvent("task_start"), hostID(c), task.Name})
+}
+
+// copy emits each line of the stream, without the line ending.
+func (o *jsonOutput) copy(task *Task, c Client, stream string, r io.Reader) error {
+	reader := bufio.NewReader(r)
+
+	for {
+		line, err := reader.ReadString('\n')
+		if line != "" {
+			o.emit(struct {
+				event
+				Host    string `json:"host"`
+				Command string `json:"command"`
+				Stream  string `json:"stream"`
+				Line    string `json:"line"`
+			}{newEvent("output"), hostID(c), task.Name, stream, strings.TrimRight(line, "\r\n")})
+		}
+
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (o *jsonOutput) taskEnd(_ *Task, _ Client, res *TaskResult) {
+	o.emit(struct {
+		event
+		Host       string `json:"host"`
+		Command    string `json:"command"`
+		Status     string `json:"status"`
+		ExitStatus int    `json:"exit_status"`
+		DurationMs int64  `json:"duration_ms"`
+		Error      string `json:"error,omitempty"`
+	}{newEvent("task_end"), res.Host, res.Command, string(res.Status), res.ExitStatus, res.Duration.Milliseconds(), errorString(res.Err)})
+}
+
+func (o *jsonOutput) notice(c Client, msg string) {
+	o.emit(struct {
+		event
+		Host    string `json:"host,omitempty"`
+		Message string `json:"message"`
+	}{newEvent("message"), hostOf(c), msg})
+}
+
+func (o *jsonOutput) warn(c Client, err error, msg string) {
+	o.emit(struct {
+		event
+		Host    string `json:"host,omitempty"`
+		Error   string `json:"error"`
+		Message string `json:"message,omitempty"`
+	}{newEvent("error"), hostOf(c), err.Error(), msg})
+}
+
+func (o *jsonOutput) runEnd(report *RunReport, err error) {
+	var summary []hostSummaryEvent
+
+	for _, host := range report.Summary() {
+		summary = append(summary, hostSummaryEvent{
+			Host:       host.Host,
+			Status:     string(host.Status),
+			OK:         host.OK,
+			Failed:     host.Failed,
+			Ignored:    host.Ignored,
+			Skipped:    host.Skipped,
+			DurationMs: host.Duration.Milliseconds(),
+			Error:      host.Error,
+		})
+	}
+
+	o.emit(struct {
+		event
+		ExitStatus int                `json:"exit_status"`
+		DurationMs int64              `json:"duration_ms"`
+		Error      string             `json:"error,omitempty"`
+		Summary    []hostSummaryEvent `json:"summary"`
+	}{newEvent("run_end"), runExitStatus(report, err), report.Duration.Milliseconds(), errorString(err), summary})
+}
+
+// runExitStatus returns the exit status of sup after the run.
+func runExitStatus(report *RunReport, err error) int {
+	if err != nil {
+		return 1
+	}
+
+	return report.ExitStatus()
+}
+
+// hostOf returns the client's host ID, or empty string for no client.
+func hostOf(c Client) string {
+	if c == nil {
+		return ""
+	}
+
+	return hostID(c)
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+
+	return err.Error()
+}
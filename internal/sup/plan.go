@@ -0,0 +1,183 @@
+package sup
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/DTreshy/sup/internal/command"
+	"github.com/DTreshy/sup/internal/envs"
+	"github.com/DTreshy/sup/internal/network"
+	"github.com/DTreshy/sup/pkg/remotetar"
+)
+
+// Plan prints the tasks that Run would execute for the given commands,
+// without connecting to any host.
+func (sup *Stackup) Plan(out io.Writer, net *network.Network, envVars envs.EnvList, commands ...*command.Command) error {
+	if len(commands) == 0 {
+		return errors.New("no commands to be run")
+	}
+
+	sup.dryRun = true
+	defer func() { sup.dryRun = false }()
+
+	env := envVars.AsExport()
+	sup.tunnels = net.Tunnels
+	sup.parallel = net.MaxParallel
+
+	if err := checkTunnels(net.Tunnels, len(net.Hosts), net.MaxParallel, commands); err != nil {
+		return err
+	}
+
+	clients := make([]Client, len(net.Hosts))
+
+	for i, host := range net.Hosts {
+		clients[i] = sup.newClient(i, host, net, env, nil)
+
+		var err error
+
+		switch c := clients[i].(type) {
+		case *LocalhostClient:
+			err = c.Connect(host.String())
+		case *SSHClient:
+			err = c.parseHost(c.addr)
+		}
+
+		if err != nil {
+			return errors.Join(err, fmt.Errorf("resolving host %v failed", host))
+		}
+	}
+
+	fmt.Fprintf(out, "Hosts (%v):\n", len(clients))
+
+	for i, c := range clients {
+		fmt.Fprintf(out, "  %v", c.Host())
+
+		name := net.Hosts[i].Name
+		if remote, ok := c.(*SSHClient); ok {
+			name = remote.name
+		}
+
+		if name != "" {
+			fmt.Fprintf(out, " (%v)", name)
+		}
+
+		if remote, ok := c.(*SSHClient); ok && len(remote.jumps) > 0 {
+			fmt.Fprintf(out, " via %v", remote.jumps)
+		}
+
+		fmt.Fprintln(out)
+	}
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		return errors.Join(err, errors.New("resolving CWD failed"))
+	}
+
+	for _, cmd := range commands {
+		tasks, err := sup.createTasks(cmd, clients, env)
+		if err != nil {
+			return errors.Join(err, errors.New("creating task failed"))
+		}
+
+		fmt.Fprintf(out, "\n%v:\n", cmd.Name)
+
+		for i, task := range tasks {
+			fmt.Fprintf(out, "  task %v/%v: %v\n", i+1, len(tasks), describeTask(task, cmd))
+
+			if task.Upload != nil {
+				files, err := remotetar.ListFiles(cwd, task.Upload.Src, task.Upload.Exc)
+				if err != nil {
+					return errors.Join(err, errors.New("upload: "+task.Upload.Src))
+				}
+
+				fmt.Fprintf(out, "    files (%v):\n", len(files))
+
+				for _, file := range files {
+					fmt.Fprintf(out, "      %v\n", file)
+				}
+			}
+
+			for _, c := range task.Clients {
+				fmt.Fprintf(out, "    %v $ %v\n", c.Host(), plannedCommand(c, task))
+
+				if task.Download != nil {
+					fmt.Fprintf(out, "      -> %v\n", downloadDir(task, c))
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// describeTask returns one line summary of the task.
+func describeTask(task *Task, cmd *command.Command) string {
+	var parts []string
+
+	if task.Upload != nil {
+		parts = append(parts, fmt.Sprintf("upload %v -> %v", task.Upload.Src, task.Upload.Dst))
+		if task.Upload.Exc != "" {
+			parts = append(parts, "exclude "+task.Upload.Exc)
+		}
+	}
+
+	if task.Download != nil {
+		parts = append(parts, fmt.Sprintf("download %v -> %v", task.Download.Src, task.Download.Dst))
+	}
+
+	switch {
+	case task.Local:
+		parts = append(parts, "local")
+	case task.Batches > 0 && cmd.Serial > 0:
+		parts = append(parts, fmt.Sprintf("serial batch %v/%v", task.Batch, task.Batches))
+	case task.Batches > 0:
+		parts = append(parts, fmt.Sprintf("max_parallel batch %v/%v", task.Batch, task.Batches))
+	case cmd.Once:
+		parts = append(parts, "once on "+task.Clients[0].Host())
+	}
+
+	if task.Input != nil && task.Upload == nil {
+		parts = append(parts, "stdin attached")
+	}
+
+	if !task.TTY && !task.Local && task.Upload == nil && task.Download == nil {
+		parts = append(parts, "no tty")
+	}
+
+	if task.Timeout > 0 {
+		parts = append(parts, fmt.Sprintf("timeout %v", task.Timeout))
+	}
+
+	if task.ForwardAgent {
+		parts = append(parts, "forward agent")
+	}
+
+	for _, tunnel := range task.Tunnels {
+		if task.Via != nil {
+			parts = append(parts, fmt.Sprintf("tunnel %v via %v", tunnel, task.Via.Host()))
+		} else {
+			parts = append(parts, "tunnel "+tunnel.String())
+		}
+	}
+
+	if len(parts) == 0 {
+		return "all hosts"
+	}
+
+	return strings.Join(parts, ", ")
+}
+
+// plannedCommand returns the exact command string that the client would run.
+func plannedCommand(c Client, task *Task) string {
+	switch c := c.(type) {
+	case *SSHClient:
+		return c.env + task.Run
+	case *LocalhostClient:
+		return c.env + task.Run
+	default:
+		return task.Run
+	}
+}
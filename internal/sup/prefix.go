@@ -0,0 +1,132 @@
+package sup
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/DTreshy/sup/pkg/colors"
+)
+
+// prefixFields are the fields of the output prefix template.
+type prefixFields struct {
+	Host    string // Address of the host, ie. api1.example.com:22.
+	Alias   string // Name of the host, its address if not set.
+	User    string
+	Command string // Name of the running command.
+	Batch   string // Number of the "serial" batch, ie. 2/5, if any.
+	Elapsed string // Time since the task started, ie. 1.25s.
+	Time    string // Wall-clock time, ie. 15:04:05.
+}
+
+// PrefixFormat sets the template of the output prefix, ie.
+// `{{.Time}} {{.Alias}} | `. Empty format keeps the default user@host prefix.
+func (sup *Stackup) PrefixFormat(format string) error {
+	if format == "" {
+		sup.prefixFormat = nil
+		return nil
+	}
+
+	tmpl, err := template.New("prefix").Option("missingkey=error").Parse(format)
+	if err != nil {
+		return errors.Join(err, errors.New("parsing prefix format failed"))
+	}
+
+	// Unknown fields only fail once executed.
+	if err := tmpl.Execute(io.Discard, prefixFields{}); err != nil {
+		return errors.Join(err, errors.New("parsing prefix format failed"))
+	}
+
+	sup.prefixFormat = tmpl
+
+	return nil
+}
+
+// prefixOf returns output prefix of the client running the task, if enabled.
+// The default prefix is left padded, the templated one is not.
+func (sup *Stackup) prefixOf(c Client, task *Task) string {
+	if !sup.prefix || c == nil {
+		return ""
+	}
+
+	if sup.prefixFormat != nil {
+		return sup.formatPrefix(c, task)
+	}
+
+	prefix, prefixLen := c.Prefix()
+	if prefixLen < sup.maxLen { // Left padding.
+		prefix = strings.Repeat(" ", sup.maxLen-prefixLen) + prefix
+	}
+
+	return prefix
+}
+
+func (sup *Stackup) formatPrefix(c Client, task *Task) string {
+	fields := prefixFields{
+		Host:  c.Host(),
+		Alias: hostName(c),
+		Time:  time.Now().Format("15:04:05"),
+	}
+
+	color := ""
+
+	switch c := c.(type) {
+	case *SSHClient:
+		fields.User = c.user
+		color = c.color
+	case *LocalhostClient:
+		fields.User = c.user
+	}
+
+	if task != nil {
+		fields.Command = task.Name
+
+		if task.Batches > 0 {
+			fields.Batch = fmt.Sprintf("%v/%v", task.Batch, task.Batches)
+		}
+
+		if !task.Started.IsZero() {
+			fields.Elapsed = time.Since(task.Started).Round(10 * time.Millisecond).String()
+		}
+	}
+
+	var buf bytes.Buffer
+
+	// The template is checked by PrefixFormat already.
+	_ = sup.prefixFormat.Execute(&buf, fields)
+
+	return color + buf.String() + colors.ResetColor
+}
+
+// copyPrefixed copies the lines read from r to w, each with the prefix
+// returned at the time of reading the line. The last line is terminated.
+func copyPrefixed(w io.Writer, r io.Reader, prefix func() string) error {
+	reader := bufio.NewReader(r)
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			if line[len(line)-1] != '\n' {
+				line = append(line, '\n')
+			}
+
+			// Write the whole line at once, not to mix it with the other hosts' lines.
+			if _, err := w.Write(append([]byte(prefix()), line...)); err != nil {
+				return err
+			}
+		}
+
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,294 @@
+package sup
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/DTreshy/sup/internal/command"
+)
+
+// TaskStatus is an outcome of a task on a single host.
+type TaskStatus string
+
+const (
+	TaskOK      TaskStatus = "ok"
+	TaskFailed  TaskStatus = "failed"
+	TaskSkipped TaskStatus = "skipped"
+	TaskIgnored TaskStatus = "ignored" // Failed, but the command has ignore_errors set.
+
+	TaskTimedOut    TaskStatus = "timed-out"   // Failed to finish within the command's timeout.
+	TaskInterrupted TaskStatus = "interrupted" // Closed by the user aborting the run.
+)
+
+// Failed reports whether the task failed, including running out of time
+// and being interrupted.
+func (s TaskStatus) Failed() bool {
+	return s == TaskFailed || s == TaskTimedOut || s == TaskInterrupted
+}
+
+// TaskResult is a result of a single task run on a single host.
+type TaskResult struct {
+	Command    string // Name of the command the task belongs to.
+	Host       string
+	Status     TaskStatus
+	ExitStatus int
+	Duration   time.Duration
+	Err        error
+}
+
+// RunReport collects results of all the tasks run by Stackup.Run.
+type RunReport struct {
+	Hosts       []string         // All the hosts of the network, in order.
+	Unreachable map[string]error // Hosts that sup failed to connect to.
+	Results     []*TaskResult
+	Duration    time.Duration
+}
+
+func newRunReport(hosts []string) *RunReport {
+	return &RunReport{
+		Hosts:       hosts,
+		Unreachable: map[string]error{},
+	}
+}
+
+func (r *RunReport) add(results ...*TaskResult) {
+	for _, res := range results {
+		if !r.hasHost(res.Host) {
+			r.Hosts = append(r.Hosts, res.Host) // Local commands run on extra localhost.
+		}
+
+		r.Results = append(r.Results, res)
+	}
+}
+
+func (r *RunReport) hasHost(host string) bool {
+	for _, h := range r.Hosts {
+		if h == host {
+			return true
+		}
+	}
+
+	return false
+}
+
+// skip records the task as skipped on all of its clients.
+func (r *RunReport) skip(task *Task) {
+	for _, c := range task.Clients {
+		r.add(&TaskResult{
+			Command: task.Name,
+			Host:    hostID(c),
+			Status:  TaskSkipped,
+		})
+	}
+}
+
+// skipCommands records the commands as skipped on the hosts they would run on.
+func (r *RunReport) skipCommands(commands []*command.Command, clients []Client) {
+	for _, cmd := range commands {
+		if cmd.Local != "" {
+			r.add(&TaskResult{Command: cmd.Name, Host: "localhost", Status: TaskSkipped})
+		}
+
+		if len(clients) == 0 || !cmd.IsRemote() {
+			continue
+		}
+
+		hosts := clients
+		if cmd.Once {
+			hosts = clients[:1]
+		}
+
+		r.skip(&Task{Name: cmd.Name, Clients: hosts})
+	}
+}
+
+// Failed reports whether any host failed to connect or to run a task.
+func (r *RunReport) Failed() bool {
+	if len(r.Unreachable) > 0 {
+		return true
+	}
+
+	for _, res := range r.Results {
+		if res.Status.Failed() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ExitStatus returns exit status of the first failed task, 1 if sup
+// failed to connect to any host, or 0 on success. Aborted run exits
+// with 130, regardless of the failures.
+func (r *RunReport) ExitStatus() int {
+	if len(r.Interrupted()) > 0 {
+		return interruptExitStatus
+	}
+
+	for _, res := range r.Results {
+		if res.Status.Failed() {
+			if res.ExitStatus > 0 {
+				return res.ExitStatus
+			}
+
+			return 1
+		}
+	}
+
+	if len(r.Unreachable) > 0 {
+		return 1
+	}
+
+	return 0
+}
+
+// Interrupted returns the hosts whose tasks were interrupted by the user.
+func (r *RunReport) Interrupted() []string {
+	var hosts []string
+
+	for _, res := range r.Results {
+		if res.Status == TaskInterrupted {
+			hosts = append(hosts, res.Host)
+		}
+	}
+
+	return hosts
+}
+
+// HostSummary is the outcome of the run on a single host.
+type HostSummary struct {
+	Host     string
+	Status   TaskStatus // Overall status, or "unreachable".
+	OK       int
+	Failed   int // Including the timed out and interrupted tasks.
+	Ignored  int
+	Skipped  int
+	Duration time.Duration
+	Error    string // First line of the first failure.
+}
+
+// hostUnreachable is the summary status of the hosts sup failed to connect to.
+const hostUnreachable TaskStatus = "unreachable"
+
+// Summary returns the outcomes of all the hosts, in order.
+func (r *RunReport) Summary() []HostSummary {
+	summary := make([]HostSummary, 0, len(r.Hosts))
+
+	for _, host := range r.Hosts {
+		if err, ok := r.Unreachable[host]; ok {
+			summary = append(summary, HostSummary{Host: host, Status: hostUnreachable, Error: firstLine(err)})
+			continue
+		}
+
+		var (
+			counts   = map[TaskStatus]int{}
+			duration time.Duration
+			failure  string
+			ignored  string
+		)
+
+		for _, res := range r.Results {
+			if res.Host != host {
+				continue
+			}
+
+			counts[res.Status]++
+			duration += res.Duration
+
+			switch {
+			case res.Status.Failed() && failure == "":
+				failure = fmt.Sprintf("%v: %v", res.Command, firstLine(res.Err))
+			case res.Status == TaskIgnored && ignored == "":
+				ignored = fmt.Sprintf("%v: %v", res.Command, firstLine(res.Err))
+			}
+		}
+
+		// The first real failure, or the first ignored one if none.
+		if failure == "" {
+			failure = ignored
+		}
+
+		status := TaskOK
+
+		switch {
+		case counts[TaskInterrupted] > 0:
+			status = TaskInterrupted
+		case counts[TaskTimedOut] > 0:
+			status = TaskTimedOut
+		case counts[TaskFailed] > 0:
+			status = TaskFailed
+		case counts[TaskOK] == 0 && counts[TaskIgnored] == 0 && counts[TaskSkipped] > 0:
+			status = TaskSkipped
+		}
+
+		summary = append(summary, HostSummary{
+			Host:     host,
+			Status:   status,
+			OK:       counts[TaskOK],
+			Failed:   counts[TaskFailed] + counts[TaskTimedOut] + counts[TaskInterrupted],
+			Ignored:  counts[TaskIgnored],
+			Skipped:  counts[TaskSkipped],
+			Duration: duration,
+			Error:    failure,
+		})
+	}
+
+	return summary
+}
+
+// PrintSummary prints a table of hosts and their task outcomes.
+func (r *RunReport) PrintSummary(out io.Writer) {
+	w := &tabwriter.Writer{}
+
+	w.Init(out, 4, 4, 2, ' ', 0)
+
+	defer w.Flush()
+
+	fmt.Fprintln(w, "Host\tStatus\tOK\tFailed\tIgnored\tSkipped\tDuration\tError")
+
+	for _, host := range r.Summary() {
+		if host.Status == hostUnreachable {
+			fmt.Fprintf(w, "%v\t%v\t-\t-\t-\t-\t-\t%v\n", host.Host, host.Status, host.Error)
+			continue
+		}
+
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\n", host.Host, host.Status, host.OK, host.Failed, host.Ignored, host.Skipped, host.Duration.Round(time.Millisecond), host.Error)
+	}
+}
+
+// exitStatus extracts exit status of a finished remote or local command.
+func exitStatus(err error) int {
+	if err == nil {
+		return 0
+	}
+
+	var sshErr *ssh.ExitError
+	if errors.As(err, &sshErr) {
+		return sshErr.ExitStatus()
+	}
+
+	var execErr *exec.ExitError
+	if errors.As(err, &execErr) && execErr.ExitCode() > 0 {
+		return execErr.ExitCode()
+	}
+
+	return 1
+}
+
+// firstLine returns the first line of the error message.
+func firstLine(err error) string {
+	if err == nil {
+		return ""
+	}
+
+	line, _, _ := strings.Cut(err.Error(), "\n")
+
+	return line
+}
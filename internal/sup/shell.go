@@ -0,0 +1,262 @@
+package sup
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"text/tabwriter"
+
+	"github.com/DTreshy/sup/internal/command"
+	"github.com/DTreshy/sup/internal/envs"
+	"github.com/DTreshy/sup/internal/network"
+)
+
+const shellHelp = `Lines are run on all the selected hosts in parallel. Shell commands:
+  :hosts                list the hosts, the selected ones are marked with "*"
+  :only [REGEXP]        select the hosts matching the regexp, all hosts if omitted
+  :run COMMAND [...]    run the Supfile commands or targets on the selected hosts
+  :help                 print this help
+  :quit                 close the connections and exit (or Ctrl-D)
+`
+
+// shell is an interactive session running commands on the network hosts.
+type shell struct {
+	sup      *Stackup
+	name     string // Network name, for the prompt.
+	env      string
+	clients  []Client // All the connected hosts.
+	selected []Client // Hosts the lines are run on.
+	out      io.Writer
+	running  atomic.Bool
+}
+
+// Shell connects to the network hosts once and runs each line read from in
+// on all of them, until EOF or :quit. Unreachable hosts are left out.
+func (sup *Stackup) Shell(net *network.Network, envVars envs.EnvList, in io.Reader, out io.Writer) error {
+	env := envVars.AsExport()
+	sup.tunnels = net.Tunnels
+	sup.parallel = net.MaxParallel
+
+	clients, _, err := sup.connect(net, env)
+	defer sup.close(clients)
+
+	if len(clients) == 0 {
+		return err
+	}
+
+	name, _ := envVars.Get("SUP_NETWORK")
+
+	sh := &shell{
+		sup:      sup,
+		name:     name,
+		env:      env,
+		clients:  clients,
+		selected: clients,
+		out:      out,
+	}
+
+	// Ctrl-C interrupts the running line only, not the shell.
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+
+	defer func() {
+		signal.Stop(interrupts)
+		close(interrupts)
+	}()
+
+	go func() {
+		for range interrupts {
+			if !sh.running.Load() {
+				fmt.Fprintln(out, "\n(use :quit or Ctrl-D to exit)")
+				sh.prompt()
+			}
+		}
+	}()
+
+	fmt.Fprintf(out, "Connected to %v hosts, type :help for help.\n", len(clients))
+
+	scanner := bufio.NewScanner(in)
+
+	for sh.prompt(); scanner.Scan(); sh.prompt() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		if line == ":quit" || line == ":exit" {
+			return nil
+		}
+
+		if err := sh.exec(line); err != nil {
+			fmt.Fprintln(out, err)
+		}
+	}
+
+	fmt.Fprintln(out)
+
+	return scanner.Err()
+}
+
+func (sh *shell) prompt() {
+	fmt.Fprintf(sh.out, "sup %v (%v/%v)> ", sh.name, len(sh.selected), len(sh.clients))
+}
+
+// exec runs the shell command or the remote command line.
+func (sh *shell) exec(line string) error {
+	keyword, args, _ := strings.Cut(line, " ")
+	args = strings.TrimSpace(args)
+
+	switch keyword {
+	case ":help":
+		fmt.Fprint(sh.out, shellHelp)
+	case ":hosts":
+		sh.printHosts()
+	case ":only":
+		return sh.only(args)
+	case ":run":
+		commands, err := sh.sup.lookupCommands(strings.Fields(args))
+		if err != nil {
+			return err
+		}
+
+		report, err := sh.run(commands)
+		if err != nil {
+			return err
+		}
+
+		report.PrintSummary(sh.out)
+	default:
+		if strings.HasPrefix(keyword, ":") {
+			return fmt.Errorf("unknown shell command %v, type :help for help", keyword)
+		}
+
+		report, err := sh.run([]*command.Command{{Name: line, Run: line}})
+		if err != nil {
+			return err
+		}
+
+		if report.Failed() {
+			failed := map[string]bool{}
+
+			for _, res := range report.Results {
+				if res.Status.Failed() {
+					failed[res.Host] = true
+				}
+			}
+
+			fmt.Fprintf(sh.out, "%v of %v hosts failed\n", len(failed), len(sh.selected))
+		}
+	}
+
+	return nil
+}
+
+// run runs the commands on the selected hosts.
+func (sh *shell) run(commands []*command.Command) (*RunReport, error) {
+	if err := checkTunnels(sh.sup.tunnels, len(sh.selected), sh.sup.parallel, commands); err != nil {
+		return nil, err
+	}
+
+	hosts := make([]string, len(sh.selected))
+	for i, c := range sh.selected {
+		hosts[i] = hostID(c)
+	}
+
+	report := newRunReport(hosts)
+
+	sh.running.Store(true)
+	defer sh.running.Store(false)
+
+	if err := sh.sup.runCommands(report, sh.selected, sh.env, commands); err != nil {
+		fmt.Fprintln(sh.out, err)
+	}
+
+	// The interrupted sessions are closed, but the connections stay open.
+	sh.sup.aborted.Store(false)
+
+	return report, nil
+}
+
+func (sh *shell) printHosts() {
+	w := tabwriter.NewWriter(sh.out, 4, 4, 2, ' ', 0)
+	defer w.Flush()
+
+	for _, c := range sh.clients {
+		mark := " "
+
+		for _, s := range sh.selected {
+			if s == c {
+				mark = "*"
+				break
+			}
+		}
+
+		fmt.Fprintf(w, "%v %v\t%v\n", mark, hostName(c), c.Host())
+	}
+}
+
+// only selects the hosts matching the regexp by their alias or address.
+func (sh *shell) only(expr string) error {
+	if expr == "" {
+		sh.selected = sh.clients
+		return nil
+	}
+
+	re, err := regexp.CompilePOSIX(expr)
+	if err != nil {
+		return err
+	}
+
+	var selected []Client
+
+	for _, c := range sh.clients {
+		if re.MatchString(c.Host()) || re.MatchString(hostName(c)) {
+			selected = append(selected, c)
+		}
+	}
+
+	if len(selected) == 0 {
+		return fmt.Errorf("no hosts match '%v' regexp", expr)
+	}
+
+	sh.selected = selected
+
+	return nil
+}
+
+// lookupCommands returns the Supfile commands of the given command
+// and target names.
+func (sup *Stackup) lookupCommands(names []string) ([]*command.Command, error) {
+	if len(names) == 0 {
+		return nil, errors.New("no commands to be run")
+	}
+
+	var commands []*command.Command
+
+	for _, name := range names {
+		cmdNames := []string{name}
+
+		target, isTarget := sup.conf.Targets.Get(name)
+		if isTarget {
+			cmdNames = target
+		}
+
+		for _, cmdName := range cmdNames {
+			cmd, ok := sup.conf.Commands.Get(cmdName)
+			if !ok {
+				return nil, fmt.Errorf("unknown command/target: %v", cmdName)
+			}
+
+			cmd.Name = cmdName
+			commands = append(commands, &cmd)
+		}
+	}
+
+	return commands, nil
+}
@@ -7,13 +7,15 @@ import (
 	"net"
 	"os"
 	"os/user"
-	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
+	"github.com/DTreshy/sup/internal/network"
 	"github.com/DTreshy/sup/pkg/colors"
 	"golang.org/x/crypto/ssh"
-	"golang.org/x/crypto/ssh/agent"
 )
 
 // Client is a wrapper over the SSH connection/sessions.
@@ -28,20 +30,65 @@ type SSHClient struct {
 	connOpened   bool
 	sessOpened   bool
 	running      bool
+	pty          bool   // The running session has a pseudo terminal.
 	env          string //export FOO="bar"; export BAR="baz";
 	color        string
+	name         string // Display alias of the host.
+	id           string // Unique name of the host in the run, see hostID.
+
+	hostKeyCallback ssh.HostKeyCallback // Defaults to strict known_hosts check.
+	identityFile    string              // Private key offered first.
+	identitiesOnly  bool                // Offer identityFile only, skip ssh-agent and ~/.ssh/id_* keys.
+	auth            []ssh.AuthMethod    // Overrides the identities above, if set.
+
+	addr                string          // Host to connect to, resolved from Supfile and ssh_config.
+	jumps               network.Bastion // Jump hosts to connect through.
+	serverAliveInterval time.Duration   // Keepalive interval, keepalives are disabled if zero.
+	serverAliveCountMax int             // Unanswered keepalives before disconnecting, 3 by default.
+	connectTimeout      time.Duration   // Timeout of the TCP connection and the key exchange, if set.
+	connectRetries      int             // Connection retries after the first failed attempt.
+	retryBackoff        time.Duration   // Delay before the first retry, doubled for each next one.
+
+	agentForwarding bool      // Forward ssh-agent to all the commands.
+	agentOnce       sync.Once // Serves the local ssh-agent to the host.
+	agentErr        error
+
+	tunnels *tunnels // Forwardings of the running task.
+
+	// Guards sess, sessOpened and pty, as the signals and timeouts reach
+	// the session from the other goroutines than the one running it.
+	sessMu sync.Mutex
+
+	// Set by the keepalive goroutine once the keepalives fail,
+	// the connection is closed.
+	dead atomic.Pointer[error]
 }
 
 type ErrConnect struct {
-	User   string
-	Host   string
-	Reason string
+	User     string
+	Host     string
+	Reason   string
+	Attempts int // Number of connection attempts made, if retried.
 }
 
 func (e ErrConnect) Error() string {
-	return fmt.Sprintf(`Connect("%v@%v"): %v`, e.User, e.Host, e.Reason)
+	return fmt.Sprintf(`Connect("%v@%v"): %v`, e.User, e.Host, e.reason())
 }
 
+// reason returns the reason of the failure, along with the number of attempts.
+func (e ErrConnect) reason() string {
+	if e.Attempts > 1 {
+		return fmt.Sprintf("%v (after %v attempts)", e.Reason, e.Attempts)
+	}
+
+	return e.Reason
+}
+
+const (
+	defaultRetryBackoff = time.Second
+	maxRetryBackoff     = time.Minute
+)
+
 // parseHost parses and normalizes <user>@<host:port> from a given string.
 func (c *SSHClient) parseHost(host string) error {
 	c.host = host
@@ -68,53 +115,31 @@ func (c *SSHClient) parseHost(host string) error {
 	}
 
 	if strings.Contains(c.host, "/") {
-		return ErrConnect{c.user, c.host, "unexpected slash in the host URL"}
+		return ErrConnect{User: c.user, Host: c.host, Reason: "unexpected slash in the host URL"}
 	}
 
 	// Add default port, if not set
-	if strings.Contains(c.host, ":") {
+	if !strings.Contains(c.host, ":") {
 		c.host += ":22"
 	}
 
 	return nil
 }
 
-var initAuthMethodOnce sync.Once
-var authMethod ssh.AuthMethod
+// splitHost splits "[ssh://][user@]host[:port]" into its parts.
+func splitHost(host string) (user, hostname, port string) {
+	hostname = strings.TrimPrefix(host, "ssh://")
 
-// initAuthMethod initiates SSH authentication method.
-func initAuthMethod() {
-	var signers []ssh.Signer
-
-	// If there's a running SSH Agent, try to use its Private keys.
-	sock, err := net.Dial("unix", os.Getenv("SSH_AUTH_SOCK"))
-	if err == nil {
-		sshAgent := agent.NewClient(sock)
-		signers, _ = sshAgent.Signers()
+	if at := strings.LastIndex(hostname, "@"); at != -1 {
+		user = hostname[:at]
+		hostname = hostname[at+1:]
 	}
 
-	// Try to read user's SSH private keys form the standard paths.
-	files, _ := filepath.Glob(os.Getenv("HOME") + "/.ssh/id_*")
-
-	for _, file := range files {
-		if strings.HasSuffix(file, ".pub") {
-			continue // Skip public keys.
-		}
-
-		data, err := os.ReadFile(file)
-		if err != nil {
-			continue
-		}
-
-		signer, err := ssh.ParsePrivateKey(data)
-		if err != nil {
-			continue
-		}
-
-		signers = append(signers, signer)
+	if h, p, err := net.SplitHostPort(hostname); err == nil {
+		hostname, port = h, p
 	}
 
-	authMethod = ssh.PublicKeys(signers...)
+	return user, hostname, port
 }
 
 // SSHDialFunc can dial an ssh server and return a client
@@ -128,44 +153,226 @@ func (c *SSHClient) Connect(host string) error {
 
 // ConnectWith creates a SSH connection to a specified host. It will use dialer to establish the
 // connection.
-// TODO: Split Signers to its own method.
 func (c *SSHClient) ConnectWith(host string, dialer SSHDialFunc) error {
 	if c.connOpened {
 		return errors.New("already connected")
 	}
 
-	initAuthMethodOnce.Do(initAuthMethod)
-
 	err := c.parseHost(host)
 	if err != nil {
 		return err
 	}
 
+	auth, identities, err := c.authMethods()
+	if err != nil {
+		return ErrConnect{User: c.user, Host: c.host, Reason: err.Error()}
+	}
+
+	if c.hostKeyCallback == nil {
+		c.hostKeyCallback, err = NewHostKeyCallback(HostKeyCheckStrict, "")
+		if err != nil {
+			return ErrConnect{User: c.user, Host: c.host, Reason: err.Error()}
+		}
+	}
+
 	config := &ssh.ClientConfig{
-		User: c.user,
-		Auth: []ssh.AuthMethod{
-			authMethod,
-		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(), //nolint:gosec // TODO: check if there is possibility to change this
+		User:            c.user,
+		Auth:            auth,
+		HostKeyCallback: c.hostKeyCallback,
+		Timeout:         c.connectTimeout,
 	}
 
-	c.conn, err = dialer("tcp", c.host, config)
-	if err != nil {
-		return ErrConnect{c.user, c.host, err.Error()}
+	backoff := c.retryBackoff
+	if backoff <= 0 {
+		backoff = defaultRetryBackoff
+	}
+
+	for attempt := 1; ; attempt++ {
+		c.conn, err = c.dial(dialer, config)
+		if err == nil {
+			break
+		}
+
+		connErr := ErrConnect{User: c.user, Host: c.host, Reason: err.Error(), Attempts: attempt}
+
+		// Don't retry the failures which wouldn't pass next time either.
+		var keyErr ErrHostKey
+		if errors.As(err, &keyErr) {
+			connErr.Reason = keyErr.Error()
+			return connErr
+		}
+
+		if strings.Contains(err.Error(), "unable to authenticate") {
+			if len(identities) > 0 {
+				connErr.Reason = fmt.Sprintf("%v (offered identities: %v)", err, strings.Join(identities, ", "))
+			}
+
+			return connErr
+		}
+
+		if attempt > c.connectRetries {
+			return connErr
+		}
+
+		time.Sleep(backoff)
+
+		if backoff *= 2; backoff > maxRetryBackoff {
+			backoff = maxRetryBackoff
+		}
 	}
 
 	c.connOpened = true
 
+	if c.serverAliveInterval > 0 {
+		go c.keepalive(c.conn)
+	}
+
 	return nil
 }
 
+// dial connects to the host. The connect timeout covers the key exchange
+// too, but not the authentication, which may wait for a passphrase.
+func (c *SSHClient) dial(dialer SSHDialFunc, config *ssh.ClientConfig) (*ssh.Client, error) {
+	if c.connectTimeout <= 0 {
+		return dialer("tcp", c.host, config)
+	}
+
+	var (
+		mu       sync.Mutex
+		verified = make(chan struct{})
+		expired  bool
+	)
+
+	// The host key is verified once the key exchange is done.
+	attempt := *config
+	attempt.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if expired {
+			return errors.New("connection timed out")
+		}
+
+		select {
+		case <-verified: // Key re-exchange.
+		default:
+			close(verified)
+		}
+
+		return config.HostKeyCallback(hostname, remote, key)
+	}
+
+	type result struct {
+		client *ssh.Client
+		err    error
+	}
+
+	done := make(chan result, 1)
+
+	go func() {
+		client, err := dialer("tcp", c.host, &attempt)
+		done <- result{client, err}
+	}()
+
+	timer := time.NewTimer(c.connectTimeout)
+	defer timer.Stop()
+
+	select {
+	case res := <-done:
+		return res.client, res.err
+	case <-verified:
+		res := <-done
+		return res.client, res.err
+	case <-timer.C:
+		mu.Lock()
+		select {
+		case <-verified:
+			mu.Unlock()
+
+			res := <-done
+
+			return res.client, res.err
+		default:
+			expired = true
+		}
+		mu.Unlock()
+
+		// Drop the connection, if it's established eventually.
+		go func() {
+			if res := <-done; res.client != nil {
+				res.client.Close()
+			}
+		}()
+
+		return nil, fmt.Errorf("connection timed out after %v", c.connectTimeout)
+	}
+}
+
+// keepalive sends keepalive requests to the server and closes the connection
+// once the server doesn't reply to serverAliveCountMax requests in a row.
+func (c *SSHClient) keepalive(conn *ssh.Client) {
+	countMax := c.serverAliveCountMax
+	if countMax <= 0 {
+		countMax = 3
+	}
+
+	closed := make(chan struct{})
+
+	go func() {
+		_ = conn.Wait()
+		close(closed)
+	}()
+
+	ticker := time.NewTicker(c.serverAliveInterval)
+	defer ticker.Stop()
+
+	missed := 0
+
+	for {
+		select {
+		case <-closed:
+			return
+		case <-ticker.C:
+		}
+
+		reply := make(chan error, 1)
+
+		go func() {
+			_, _, err := conn.SendRequest("keepalive@openssh.com", true, nil)
+			reply <- err
+		}()
+
+		select {
+		case err := <-reply:
+			if err != nil {
+				return
+			}
+
+			missed = 0
+		case <-time.After(c.serverAliveInterval):
+			missed++
+			if missed >= countMax {
+				dead := fmt.Errorf("connection lost, no reply to %v keepalives", missed)
+				c.dead.Store(&dead)
+				conn.Close()
+
+				return
+			}
+		}
+	}
+}
+
 // Run runs the task.Run command remotely on c.host.
 func (c *SSHClient) Run(task *Task) error {
 	if c.running {
 		return errors.New("session already running")
 	}
 
-	if c.sessOpened {
+	c.sessMu.Lock()
+	sessOpened := c.sessOpened
+	c.sessMu.Unlock()
+
+	if sessOpened {
 		return errors.New("session already connected")
 	}
 
@@ -174,6 +381,14 @@ func (c *SSHClient) Run(task *Task) error {
 		return err
 	}
 
+	// Close the session, unless the command is started.
+	started := false
+	defer func() {
+		if !started {
+			sess.Close()
+		}
+	}()
+
 	c.remoteStdin, err = sess.StdinPipe()
 	if err != nil {
 		return err
@@ -196,19 +411,45 @@ func (c *SSHClient) Run(task *Task) error {
 			ssh.TTY_OP_ISPEED: 14400, // input speed = 14.4kbaud
 			ssh.TTY_OP_OSPEED: 14400, // output speed = 14.4kbaud
 		}
-		// Request pseudo terminal
-		if err := sess.RequestPty("xterm", 80, 40, modes); err != nil {
+		// Request pseudo terminal of the local terminal's type and size
+		width, height := terminalSize()
+		if err := sess.RequestPty(terminalType(), height, width, modes); err != nil {
 			return ErrTask{task, fmt.Sprintf("request for pseudo terminal failed: %s", err)}
 		}
 	}
 
+	if task.ForwardAgent || c.agentForwarding {
+		if err := c.forwardAgent(sess); err != nil {
+			return ErrTask{task, fmt.Sprintf("agent forwarding failed: %s", err)}
+		}
+	}
+
+	env := c.env
+
+	if len(task.Tunnels) > 0 {
+		tunnels, exports, err := openTunnels(c.conn, task.Tunnels)
+		if err != nil {
+			return ErrTask{task, err.Error()}
+		}
+
+		c.tunnels = tunnels
+		env += exports
+	}
+
 	// Start the remote command.
-	if err := sess.Start(c.env + task.Run); err != nil {
+	if err := sess.Start(env + task.Run); err != nil {
+		c.tunnels.Close()
 		return ErrTask{task, err.Error()}
 	}
 
+	started = true
+
+	c.sessMu.Lock()
 	c.sess = sess
 	c.sessOpened = true
+	c.pty = task.TTY
+	c.sessMu.Unlock()
+
 	c.running = true
 
 	return nil
@@ -221,10 +462,23 @@ func (c *SSHClient) Wait() error {
 		return errors.New("trying to wait on stopped session")
 	}
 
-	err := c.sess.Wait()
-	c.sess.Close()
-	c.running = false
+	c.sessMu.Lock()
+	sess := c.sess
+	c.sessMu.Unlock()
+
+	err := sess.Wait()
+	if dead := c.dead.Load(); err != nil && dead != nil {
+		err = ErrConnect{User: c.user, Host: c.host, Reason: (*dead).Error()}
+	}
+
+	c.sessMu.Lock()
+	sess.Close()
 	c.sessOpened = false
+	c.sessMu.Unlock()
+
+	c.tunnels.Close()
+	c.tunnels = nil
+	c.running = false
 
 	return err
 }
@@ -246,10 +500,12 @@ func (sc *SSHClient) DialThrough(protocol, addr string, config *ssh.ClientConfig
 
 // Close closes the underlying SSH connection and session.
 func (c *SSHClient) Close() error {
+	c.sessMu.Lock()
 	if c.sessOpened {
 		c.sess.Close()
 		c.sessOpened = false
 	}
+	c.sessMu.Unlock()
 
 	if !c.connOpened {
 		return errors.New("trying to close the already closed connection")
@@ -274,8 +530,16 @@ func (c *SSHClient) Stdout() io.Reader {
 	return c.remoteStdout
 }
 
+func (c *SSHClient) Host() string {
+	return c.host
+}
+
 func (c *SSHClient) Prefix() (prefix string, prefixLen int) {
 	host := c.user + "@" + c.host + " | "
+	if c.name != "" {
+		host = c.name + " | "
+	}
+
 	return c.color + host + colors.ResetColor, len(host)
 }
 
@@ -288,6 +552,9 @@ func (c *SSHClient) WriteClose() error {
 }
 
 func (c *SSHClient) Signal(sig os.Signal) error {
+	c.sessMu.Lock()
+	defer c.sessMu.Unlock()
+
 	if !c.sessOpened {
 		return errors.New("session is not open")
 	}
@@ -299,13 +566,46 @@ func (c *SSHClient) Signal(sig os.Signal) error {
 		// which sounds like something that should be fixed/resolved
 		// upstream in the golang.org/x/crypto/ssh pkg.
 		// https://github.com/golang/go/issues/4115#issuecomment-66070418
-		_, err := c.remoteStdin.Write([]byte("\x03"))
-		if err != nil {
-			return err
+		// Without a pseudo terminal, \x03 would be just the command's input.
+		if c.pty {
+			_, err := c.remoteStdin.Write([]byte("\x03"))
+			if err != nil {
+				return err
+			}
 		}
 
 		return c.sess.Signal(ssh.SIGINT)
+	case syscall.SIGTERM:
+		return c.sess.Signal(ssh.SIGTERM)
+	case syscall.SIGHUP:
+		return c.sess.Signal(ssh.SIGHUP)
+	case syscall.SIGQUIT:
+		return c.sess.Signal(ssh.SIGQUIT)
 	default:
 		return fmt.Errorf("%v not supported", sig)
 	}
 }
+
+// WindowChange resizes the pseudo terminal of the running command.
+func (c *SSHClient) WindowChange(width, height int) error {
+	c.sessMu.Lock()
+	defer c.sessMu.Unlock()
+
+	if !c.sessOpened {
+		return errors.New("session is not open")
+	}
+
+	return c.sess.WindowChange(height, width)
+}
+
+// Kill closes the session of the running command. The connection stays open.
+func (c *SSHClient) Kill() error {
+	c.sessMu.Lock()
+	defer c.sessMu.Unlock()
+
+	if !c.sessOpened {
+		return errors.New("session is not open")
+	}
+
+	return c.sess.Close()
+}
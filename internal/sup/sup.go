@@ -6,280 +6,603 @@ import (
 	"io"
 	"os"
 	"os/signal"
+	"regexp"
 	"strings"
 	"sync"
-
-	"github.com/goware/prefixer"
-	"golang.org/x/crypto/ssh"
+	"sync/atomic"
+	"syscall"
+	"text/template"
+	"time"
 
 	"github.com/DTreshy/sup/internal/command"
 	"github.com/DTreshy/sup/internal/envs"
 	"github.com/DTreshy/sup/internal/network"
 	"github.com/DTreshy/sup/internal/supfile"
-	"github.com/DTreshy/sup/pkg/colors"
+	"github.com/DTreshy/sup/pkg/remotetar"
+	"github.com/DTreshy/sup/pkg/sshconfig"
 )
 
 const VERSION = "0.5"
 
+const (
+	// timeoutGracePeriod is the time the timed out command has to exit
+	// after being signaled, before it's killed.
+	timeoutGracePeriod = 5 * time.Second
+
+	// timeoutExitStatus is the exit status of the timed out commands,
+	// the same as timeout(1) uses.
+	timeoutExitStatus = 124
+
+	// abortInterval is the time to press Ctrl-C again to abort the run.
+	abortInterval = 3 * time.Second
+
+	// interruptExitStatus is the exit status of the aborted run (128 + SIGINT).
+	interruptExitStatus = 130
+)
+
 type Stackup struct {
-	conf   *supfile.Supfile
-	debug  bool
-	prefix bool
+	conf     *supfile.Supfile
+	debug    bool
+	timeout  time.Duration // Default timeout of the commands.
+	aborted  atomic.Bool   // Set once the user aborts the run by double Ctrl-C.
+	prefix   bool
+	dryRun   bool
+	out      output    // Presents the progress and the commands' output.
+	logDir   string    // Directory of the runs' logs, if set.
+	maxLen   int       // Length of the longest prefix, for left padding.
+	parallel int       // Hosts connected to and running a task at once, unlimited if 0.
+	bastions *bastions // Jump host connections, closed after the run.
+
+	sshConfig *sshconfig.Config // Applied to every SSH host, if set.
+	tunnels   []network.Tunnel  // Network tunnels of the current run.
+	normalize []*regexp.Regexp  // Output parts ignored by the aggregate output.
+
+	prefixFormat *template.Template // Template of the output prefix, if set.
 }
 
 func New(conf *supfile.Supfile) (*Stackup, error) {
-	return &Stackup{
+	sup := &Stackup{
 		conf: conf,
-	}, nil
+	}
+	sup.out = textOutput{sup: sup}
+
+	return sup, nil
 }
 
 // Run runs set of commands on multiple hosts defined by network sequentially.
-// TODO: This megamoth method needs a big refactor and should be split
-//
-//	to multiple smaller methods.
-func (sup *Stackup) Run(net *network.Network, envVars envs.EnvList, commands ...*command.Command) error {
+// It stops at the first failed task and returns report of all the task results.
+// Unreachable hosts count as failed in every remote command. The error is
+// returned only if the commands couldn't be run at all.
+func (sup *Stackup) Run(net *network.Network, envVars envs.EnvList, commands ...*command.Command) (*RunReport, error) {
 	if len(commands) == 0 {
-		return errors.New("no commands to be run")
+		return nil, errors.New("no commands to be run")
 	}
 
+	start := time.Now()
 	env := envVars.AsExport()
+	sup.tunnels = net.Tunnels
+	sup.parallel = net.MaxParallel
 
-	// Create clients for every host (either SSH or Localhost).
-	var bastion *SSHClient
+	if err := checkTunnels(net.Tunnels, len(net.Hosts), net.MaxParallel, commands); err != nil {
+		return nil, err
+	}
 
-	if net.Bastion != "" {
-		bastion = &SSHClient{}
-		if err := bastion.Connect(net.Bastion); err != nil {
-			return errors.Join(err, errors.New("connecting to bastion failed"))
+	// Log the output of the run along with printing it.
+	if sup.logDir != "" {
+		logs, err := newLogOutput(sup.logDir, sup.out)
+		if err != nil {
+			return nil, err
 		}
-	}
 
-	var wg sync.WaitGroup
+		console := sup.out
+		sup.out = logs
 
-	clientCh := make(chan Client, len(net.Hosts))
-	errCh := make(chan error, len(net.Hosts))
+		defer func() { sup.out = console }()
+	}
 
+	hosts := make([]string, len(net.Hosts))
 	for i, host := range net.Hosts {
-		wg.Add(1)
+		hosts[i] = host.String()
+	}
 
-		go func(i int, host string) {
-			defer wg.Done()
+	names := make([]string, len(commands))
+	for i, cmd := range commands {
+		names[i] = cmd.Name
+	}
 
-			// Localhost client.
-			if host == "localhost" {
-				local := &LocalhostClient{
-					env: env + `export SUP_HOST="` + host + `";`,
-				}
-				if err := local.Connect(host); err != nil {
-					errCh <- errors.Join(err, errors.New("connecting to localhost failed"))
-					return
-				}
+	network, _ := envVars.Get("SUP_NETWORK")
+	sup.out.runStart(network, hosts, names)
 
-				clientCh <- local
+	clients, report, err := sup.connect(net, env)
+	defer sup.close(clients)
 
-				return
+	if errors.Is(err, errUnreachable) {
+		err = nil // Up to the commands' failure tolerance.
+	}
+
+	if err != nil {
+		report.skipCommands(commands, clients)
+	} else {
+		err = sup.runCommands(report, clients, env, commands)
+	}
+
+	report.Duration = time.Since(start)
+	sup.out.runEnd(report, err)
+
+	return report, err
+}
+
+// runCommands runs the commands on the connected clients sequentially and
+// adds the task results to the report. It stops at the first failed task.
+func (sup *Stackup) runCommands(report *RunReport, clients []Client, env string, commands []*command.Command) error {
+	// Hosts that failed a command are dropped from the subsequent ones.
+	failed := map[Client]bool{}
+	unreachable := len(report.Unreachable)
+
+	// Run command or run multiple commands defined by target sequentially.
+	for i, cmd := range commands {
+		active, dropped := dropFailed(&Task{Name: cmd.Name, Clients: clients}, failed)
+		if dropped != nil && !cmd.Once && cmd.IsRemote() {
+			report.skip(dropped)
+		}
+
+		if len(active) == 0 {
+			// All the hosts failed already, don't run even the local commands.
+			report.skipCommands(commands[i:], active)
+			return nil
+		}
+
+		// Translate command into task(s).
+		tasks, err := sup.createTasks(cmd, active, env)
+		if err != nil {
+			return errors.Join(err, errors.New("creating task failed"))
+		}
+
+		cmdFailed := map[Client]bool{}
+
+		// Unreachable hosts would have failed the command too.
+		cmdUnreachable := 0
+		if cmd.IsRemote() && !cmd.Once {
+			cmdUnreachable = unreachable
+		}
+
+		maxFailures := cmd.MaxFailures(len(active) + cmdUnreachable)
+
+		if cmdUnreachable > maxFailures {
+			if maxFailures > 0 {
+				sup.out.notice(nil, fmt.Sprintf("%v: %v hosts unreachable, only %v allowed to fail", cmd.Name, cmdUnreachable, maxFailures))
 			}
 
-			// SSH client.
-			remote := &SSHClient{
-				env:   env + `export SUP_HOST="` + host + `";`,
-				user:  net.User,
-				color: colors.Colors[i%len(colors.Colors)],
+			report.skipCommands(commands[i:], active)
+
+			return nil
+		}
+
+		// Run tasks sequentially.
+		for j, task := range tasks {
+			// Hosts that failed previous task of the command don't continue.
+			var skipped *Task
+
+			task.Clients, skipped = dropFailed(task, cmdFailed)
+			if skipped != nil {
+				report.skip(skipped)
 			}
 
-			if bastion != nil {
-				if err := remote.ConnectWith(host, bastion.DialThrough); err != nil {
-					errCh <- errors.Join(err, errors.New("connecting to remote host through bastion failed"))
-					return
+			results := sup.runTask(task)
+
+			if sup.aborted.Load() {
+				// Interrupted by the user, don't run anything else.
+				report.add(results...)
+
+				sup.out.notice(nil, "Aborted, interrupted hosts: "+strings.Join(report.Interrupted(), ", "))
+
+				for _, task := range tasks[j+1:] {
+					report.skip(task)
 				}
-			} else {
-				if err := remote.Connect(host); err != nil {
-					errCh <- errors.Join(err, errors.New("connecting to remote host failed"))
-					return
+
+				report.skipCommands(commands[i+1:], active)
+
+				return nil
+			}
+
+			for k, res := range results {
+				if res.Status.Failed() {
+					cmdFailed[task.Clients[k]] = true
 				}
 			}
-			clientCh <- remote
-		}(i, host)
+
+			report.add(results...)
+
+			if len(cmdFailed)+cmdUnreachable <= maxFailures {
+				continue
+			}
+
+			if maxFailures > 0 {
+				sup.out.notice(nil, fmt.Sprintf("%v: %v hosts failed, only %v allowed to fail", cmd.Name, len(cmdFailed)+cmdUnreachable, maxFailures))
+			}
+
+			// Skip the rest of the tasks on failure.
+			for _, task := range tasks[j+1:] {
+				report.skip(task)
+			}
+
+			report.skipCommands(commands[i+1:], active)
+
+			return nil
+		}
+
+		for c := range cmdFailed {
+			failed[c] = true
+		}
 	}
 
-	wg.Wait()
-	close(clientCh)
-	close(errCh)
+	return nil
+}
 
-	maxLen := 0
+// dropFailed splits task clients to those that should run the task and
+// those that failed already. The latter are returned as a skipped task.
+func dropFailed(task *Task, failed map[Client]bool) ([]Client, *Task) {
+	if len(failed) == 0 {
+		return task.Clients, nil
+	}
 
-	var clients []Client
+	var clients, skipped []Client
 
-	for client := range clientCh {
-		_, prefixLen := client.Prefix()
-		if prefixLen > maxLen {
-			maxLen = prefixLen
+	for _, c := range task.Clients {
+		if failed[c] {
+			skipped = append(skipped, c)
+		} else {
+			clients = append(clients, c)
 		}
+	}
 
-		clients = append(clients, client)
+	if len(skipped) == 0 {
+		return clients, nil
 	}
 
-	defer closeRemotes(clients)
+	return clients, &Task{Name: task.Name, Clients: skipped}
+}
+
+// runTask runs the task on all its clients in parallel and waits for them to finish.
+// With max_parallel set, the clients wait for a free slot to start the task.
+func (sup *Stackup) runTask(task *Task) []*TaskResult {
+	var (
+		writers []io.Writer
+		started []Client
+		wg      sync.WaitGroup
+	)
+
+	results := make([]*TaskResult, len(task.Clients))
+	running := make([]atomic.Bool, len(task.Clients))
+	output := make([]sync.WaitGroup, len(task.Clients))
+	finished := make([]chan struct{}, len(task.Clients))
+	timedOut := make([]atomic.Bool, len(task.Clients))
+	interrupted := make([]atomic.Bool, len(task.Clients))
+	slots := newSlots(sup.parallel)
+	start := time.Now()
+
+	task.Started = start
+
+	// Catch OS signals and pass them to all active clients.
+	trap := make(chan os.Signal, 2)
+
+	signal.Notify(trap, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT)
+
+	go func() {
+		var lastInterrupt time.Time
+
+		for sig := range trap {
+			// Second Ctrl-C in a row closes all the sessions.
+			if sig == os.Interrupt && time.Since(lastInterrupt) < abortInterval {
+				sup.aborted.Store(true)
+
+				for i, c := range task.Clients {
+					if !running[i].Load() || isClosed(finished[i]) {
+						continue
+					}
+
+					interrupted[i].Store(true)
+
+					if err := c.Kill(); err != nil {
+						sup.out.warn(c, err, "closing session failed")
+					}
+				}
 
-	for err := range errCh {
-		return errors.Join(err, errors.New("connecting to clients failed"))
+				continue
+			}
+
+			if sig == os.Interrupt {
+				lastInterrupt = time.Now()
+
+				sup.out.notice(nil, fmt.Sprintf("Interrupting, press Ctrl-C again within %v to abort", abortInterval))
+			}
+
+			for i, c := range task.Clients {
+				if !running[i].Load() || isClosed(finished[i]) {
+					continue
+				}
+
+				if err := c.Signal(sig); err != nil {
+					sup.out.warn(c, err, "sending signal failed")
+				}
+			}
+		}
+	}()
+
+	// Resize the remote terminals along with the local one.
+	winch := make(chan os.Signal, 1)
+
+	if task.TTY {
+		signal.Notify(winch, syscall.SIGWINCH)
 	}
 
-	// Run command or run multiple commands defined by target sequentially.
-	for _, cmd := range commands {
-		// Translate command into task(s).
-		tasks, err := sup.createTasks(cmd, clients, env)
+	go func() {
+		for range winch {
+			width, height := terminalSize()
+
+			for i, c := range task.Clients {
+				remote, ok := c.(*SSHClient)
+				if !ok || !running[i].Load() || isClosed(finished[i]) {
+					continue
+				}
+
+				_ = remote.WindowChange(width, height)
+			}
+		}
+	}()
+
+	// Run tasks on the provided clients.
+	for i, c := range task.Clients {
+		results[i] = &TaskResult{
+			Command: task.Name,
+			Host:    hostID(c),
+			Status:  TaskOK,
+		}
+
+		slots.acquire()
+
+		if sup.aborted.Load() {
+			// Don't start the clients still waiting for a slot.
+			slots.release()
+
+			results[i].Status = TaskSkipped
+			sup.endTask(task, c, results[i])
+
+			continue
+		}
+
+		err := c.Run(task)
 		if err != nil {
-			return errors.Join(err, errors.New("creating task failed"))
+			slots.release()
+
+			sup.out.warn(c, err, "task failed")
+
+			results[i].Status = TaskFailed
+			results[i].ExitStatus = exitStatus(err)
+			results[i].Err = errors.Join(err, errors.New("task failed"))
+			sup.endTask(task, c, results[i])
+
+			continue
 		}
 
-		// Run tasks sequentially.
-		for _, task := range tasks {
-			var (
-				writers []io.Writer
-				wg      sync.WaitGroup
-			)
-
-			// Run tasks on the provided clients.
-			for _, c := range task.Clients {
-				var (
-					prefix    string
-					prefixLen int
-				)
-
-				if sup.prefix {
-					prefix, prefixLen = c.Prefix()
-					if len(prefix) < maxLen { // Left padding.
-						prefix = strings.Repeat(" ", maxLen-prefixLen) + prefix
-					}
+		finished[i] = make(chan struct{})
+		running[i].Store(true)
+
+		sup.out.taskStart(task, c)
+
+		if task.Timeout > 0 {
+			go sup.expire(c, task.Timeout, finished[i], &timedOut[i])
+		}
+
+		out := &output[i]
+
+		// Copy over tasks's STDOUT.
+		out.Add(1)
+
+		if task.Download != nil {
+			// STDOUT is the tar stream of the downloaded files.
+			go func(c Client, res *TaskResult) {
+				defer out.Done()
+
+				err := remotetar.Extract(c.Stdout(), downloadDir(task, c))
+				if err != nil {
+					sup.out.warn(c, err, "download failed")
+
+					res.Status = TaskFailed
+					res.ExitStatus = 1
+					res.Err = errors.Join(err, errors.New("download failed"))
 				}
 
-				err := c.Run(task)
+				// Let the remote command finish.
+				_, _ = io.Copy(io.Discard, c.Stdout())
+			}(c, results[i])
+		} else {
+			go func(c Client) {
+				defer out.Done()
+
+				err := sup.out.copy(task, c, streamStdout, c.Stdout())
 				if err != nil {
-					return errors.Join(err, errors.New(prefix+"task failed"))
+					sup.out.warn(c, err, "reading STDOUT failed")
 				}
+			}(c)
+		}
 
-				// Copy over tasks's STDOUT.
-				wg.Add(1)
+		// Copy over tasks's STDERR.
+		out.Add(1)
 
-				go func(c Client) {
-					defer wg.Done()
+		go func(c Client) {
+			defer out.Done()
 
-					_, err := io.Copy(os.Stdout, prefixer.New(c.Stdout(), prefix))
-					if err != nil && err != io.EOF {
-						// TODO: io.Copy() should not return io.EOF at all.
-						// Upstream bug? Or prefixer.WriteTo() bug?
-						fmt.Fprintf(os.Stderr, "%v", errors.Join(err, errors.New(prefix+"reading STDOUT failed")))
-					}
-				}(c)
+			err := sup.out.copy(task, c, streamStderr, c.Stderr())
+			if err != nil {
+				sup.out.warn(c, err, "reading STDERR failed")
+			}
+		}(c)
 
-				// Copy over tasks's STDERR.
-				wg.Add(1)
+		// Make sure the client finishes the task, collect the failure.
+		wg.Add(1)
 
-				go func(c Client) {
-					defer wg.Done()
+		go func(i int, c Client, res *TaskResult) {
+			defer wg.Done()
+			defer sup.endTask(task, c, res)
 
-					_, err := io.Copy(os.Stderr, prefixer.New(c.Stderr(), prefix))
-					if err != nil && err != io.EOF {
-						fmt.Fprintf(os.Stderr, "%v", errors.Join(err, errors.New(prefix+"reading STDERR failed")))
-					}
-				}(c)
+			// Wait for the client's I/O operations first.
+			output[i].Wait()
 
-				writers = append(writers, c.Stdin())
+			err := c.Wait()
+			res.Duration = time.Since(start)
+
+			close(finished[i])
+			slots.release()
+
+			if interrupted[i].Load() {
+				res.Status = TaskInterrupted
+				res.ExitStatus = interruptExitStatus
+				res.Err = errors.New("interrupted")
+
+				return
 			}
 
-			// Copy over task's STDIN.
-			if task.Input != nil {
-				go func() {
-					writer := io.MultiWriter(writers...)
+			if timedOut[i].Load() {
+				res.Status = TaskTimedOut
+				res.ExitStatus = timeoutExitStatus
+				res.Err = fmt.Errorf("timed out after %v", task.Timeout)
 
-					_, err := io.Copy(writer, task.Input)
-					if err != nil && err != io.EOF {
-						fmt.Fprintf(os.Stderr, "%v", errors.Join(err, errors.New("copying STDIN failed")))
-					}
-					// TODO: Use MultiWriteCloser (not in Stdlib), so we can writer.Close() instead?
-					for _, c := range clients {
-						c.WriteClose()
-					}
-				}()
+				return
 			}
 
-			// Catch OS signals and pass them to all active clients.
-			trap := make(chan os.Signal, 1)
+			if err != nil {
+				sup.out.warn(c, err, "")
 
-			signal.Notify(trap, os.Interrupt)
+				res.Status = TaskFailed
+				res.ExitStatus = exitStatus(err)
+				res.Err = err
+			}
+		}(i, c, results[i])
 
-			go func() {
-				for {
-					sig, ok := <-trap
-					if !ok {
-						return
-					}
+		writers = append(writers, c.Stdin())
+		started = append(started, c)
+	}
 
-					for _, c := range task.Clients {
-						err := c.Signal(sig)
-						if err != nil {
-							fmt.Fprintf(os.Stderr, "%v", errors.Join(err, errors.New("sending signal failed")))
-						}
-					}
-				}
-			}()
+	// Copy over task's STDIN. The tasks with input are never larger than
+	// max_parallel, so all their clients are started by now.
+	if task.Input != nil {
+		go func() {
+			writer := io.MultiWriter(writers...)
+
+			_, err := io.Copy(writer, task.Input)
+			if err != nil && err != io.EOF {
+				sup.out.warn(nil, err, "copying STDIN failed")
+			}
+			// TODO: Use MultiWriteCloser (not in Stdlib), so we can writer.Close() instead?
+			for _, c := range started {
+				c.WriteClose()
+			}
+		}()
+	}
 
-			// Wait for all I/O operations first.
-			wg.Wait()
+	// Wait for all commands to finish.
+	wg.Wait()
 
-			// Make sure each client finishes the task, return on failure.
-			for _, c := range task.Clients {
-				wg.Add(1)
+	// Stop catching signals for the currently active clients.
+	signal.Stop(trap)
+	close(trap)
 
-				go func(c Client) {
-					defer wg.Done()
+	signal.Stop(winch)
+	close(winch)
 
-					if err := c.Wait(); err != nil {
-						var prefix string
+	return results
+}
 
-						if sup.prefix {
-							var prefixLen int
+// endTask reports the end of the task on the client. Failures of the task
+// ignoring errors are reported as ignored, unless interrupted by the user.
+func (sup *Stackup) endTask(task *Task, c Client, res *TaskResult) {
+	if task.IgnoreErrors && res.Status.Failed() && res.Status != TaskInterrupted {
+		res.Status = TaskIgnored
+	}
 
-							prefix, prefixLen = c.Prefix()
+	sup.out.taskEnd(task, c, res)
+}
 
-							if len(prefix) < maxLen { // Left padding.
-								prefix = strings.Repeat(" ", maxLen-prefixLen) + prefix
-							}
-						}
+// expire terminates the client's command, unless it's finished within
+// the timeout. The command is signaled first, and killed after a grace period.
+func (sup *Stackup) expire(c Client, timeout time.Duration, finished <-chan struct{}, timedOut *atomic.Bool) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
 
-						if e, ok := err.(*ssh.ExitError); ok && e.ExitStatus() != 15 {
-							// TODO: Store all the errors, and print them after Wait().
-							fmt.Fprintf(os.Stderr, "%s%v\n", prefix, e)
-							os.Exit(e.ExitStatus())
-						}
+	select {
+	case <-finished:
+		return
+	case <-timer.C:
+	}
 
-						fmt.Fprintf(os.Stderr, "%s%v\n", prefix, err)
+	timedOut.Store(true)
 
-						// TODO: Shouldn't os.Exit(1) here. Instead, collect the exit statuses for later.
-						os.Exit(1)
-					}
-				}(c)
-			}
+	sup.out.notice(c, fmt.Sprintf("timed out after %v, terminating", timeout))
 
-			// Wait for all commands to finish.
-			wg.Wait()
+	if err := c.Signal(syscall.SIGTERM); err != nil {
+		sup.out.warn(c, err, "sending signal failed")
+	}
 
-			// Stop catching signals for the currently active clients.
-			signal.Stop(trap)
-			close(trap)
-		}
+	timer.Reset(timeoutGracePeriod)
+
+	select {
+	case <-finished:
+		return
+	case <-timer.C:
 	}
 
-	return nil
+	if err := c.Kill(); err != nil {
+		sup.out.warn(c, err, "killing command failed")
+	}
+}
+
+// slots limits the number of concurrent operations, nil means no limit.
+type slots chan struct{}
+
+func newSlots(n int) slots {
+	if n <= 0 {
+		return nil
+	}
+
+	return make(slots, n)
 }
 
-func closeRemotes(clients []Client) {
+// acquire blocks until a slot is free.
+func (s slots) acquire() {
+	if s != nil {
+		s <- struct{}{}
+	}
+}
+
+func (s slots) release() {
+	if s != nil {
+		<-s
+	}
+}
+
+// isClosed reports whether the channel is closed.
+func isClosed(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+// close closes all the remote connections, including the bastion ones.
+func (sup *Stackup) close(clients []Client) {
 	for _, client := range clients {
 		if remote, ok := client.(*SSHClient); ok {
 			remote.Close()
 		}
 	}
+
+	if sup.bastions != nil {
+		sup.bastions.close()
+		sup.bastions = nil
+	}
 }
 
 func (sup *Stackup) Debug(value bool) {
@@ -289,3 +612,13 @@ func (sup *Stackup) Debug(value bool) {
 func (sup *Stackup) Prefix(value bool) {
 	sup.prefix = value
 }
+
+// Timeout sets the timeout of the commands without their own one.
+func (sup *Stackup) Timeout(value time.Duration) {
+	sup.timeout = value
+}
+
+// SSHConfig sets ssh_config to be applied to the hosts.
+func (sup *Stackup) SSHConfig(conf *sshconfig.Config) {
+	sup.sshConfig = conf
+}
@@ -5,17 +5,34 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"time"
 
 	"github.com/DTreshy/sup/internal/command"
+	"github.com/DTreshy/sup/internal/network"
 	"github.com/DTreshy/sup/pkg/remotetar"
 )
 
 // Task represents a set of commands to be run.
 type Task struct {
-	Run     string
-	Input   io.Reader
-	Clients []Client
-	TTY     bool
+	Name     string // Name of the command the task was created from.
+	Run      string
+	Input    io.Reader
+	Clients  []Client
+	TTY      bool
+	Local    bool              // Local command, run on localhost regardless of the network.
+	Batch    int               // Number of the "serial" (or max_parallel) batch, starting from 1.
+	Batches  int               // Total number of the batches.
+	Upload   *command.Upload   // Upload the task receives, with resolved Src path.
+	Download *command.Download // Download the task sends, with resolved Dst path.
+
+	ForwardAgent bool             // Forward the local ssh-agent to the hosts.
+	Tunnels      []network.Tunnel // Port forwardings open while the task runs.
+	Via          Client           // Host the tunnels of the local task lead to.
+	Timeout      time.Duration    // Time limit of the task on each host, if set.
+	Stream       bool             // Print the output live, even in the grouped output mode.
+	IgnoreErrors bool             // Failures are reported as ignored, see TaskIgnored.
+	Started      time.Time        // Time the task started running, for the output prefix.
 }
 
 var debugRun = "set -x;"
@@ -28,6 +45,9 @@ func (sup *Stackup) createTasks(cmd *command.Command, clients []Client, env stri
 		return nil, errors.Join(err, errors.New("resolving CWD failed"))
 	}
 
+	// Network tunnels are open around every command.
+	tunnels := append(append([]network.Tunnel{}, sup.tunnels...), cmd.Tunnels...)
+
 	// Anything to upload?
 	for _, upload := range cmd.Upload {
 		uploadFile, err := ResolveLocalPath(cwd, upload.Src, env)
@@ -35,36 +55,24 @@ func (sup *Stackup) createTasks(cmd *command.Command, clients []Client, env stri
 			return nil, errors.Join(err, errors.New("upload: "+upload.Src))
 		}
 
-		uploadTarReader, err := remotetar.NewTarStreamReader(cwd, uploadFile, upload.Exc)
-		if err != nil {
-			return nil, errors.Join(err, errors.New("upload: "+upload.Src))
+		task := Task{
+			Name:   cmd.Name,
+			Run:    remotetar.RemoteTarCommand(upload.Dst),
+			TTY:    false,
+			Upload: &command.Upload{Src: uploadFile, Dst: upload.Dst, Exc: upload.Exc},
 		}
 
-		task := Task{
-			Run:   remotetar.RemoteTarCommand(upload.Dst),
-			Input: uploadTarReader,
-			TTY:   false,
-		}
-
-		switch {
-		case cmd.Once:
-			task.Clients = []Client{clients[0]}
-			tasks = append(tasks, &task)
-		case cmd.Serial > 0:
-			// Each "serial" task client group is executed sequentially.
-			for i := 0; i < len(clients); i += cmd.Serial {
-				j := i + cmd.Serial
-				if j > len(clients) {
-					j = len(clients)
+		// Each batch reads its own stream. Don't create
+		// the streams just to print the plan.
+		for _, t := range sup.distribute(&task, cmd, clients) {
+			if !sup.dryRun {
+				t.Input, err = remotetar.NewTarStreamReader(cwd, uploadFile, upload.Exc)
+				if err != nil {
+					return nil, errors.Join(err, errors.New("upload: "+upload.Src))
 				}
-
-				taskCopy := task
-				taskCopy.Clients = clients[i:j]
-				tasks = append(tasks, &taskCopy)
 			}
-		default:
-			task.Clients = clients
-			tasks = append(tasks, &task)
+
+			tasks = append(tasks, t)
 		}
 	}
 
@@ -81,8 +89,12 @@ func (sup *Stackup) createTasks(cmd *command.Command, clients []Client, env stri
 		}
 
 		task := Task{
-			Run: string(data),
-			TTY: true,
+			Name:         cmd.Name,
+			Run:          string(data),
+			TTY:          cmd.UseTTY(),
+			ForwardAgent: cmd.ForwardAgent,
+			Tunnels:      tunnels,
+			Stream:       cmd.Stream,
 		}
 		if sup.debug {
 			task.Run = debugRun + task.Run
@@ -92,26 +104,7 @@ func (sup *Stackup) createTasks(cmd *command.Command, clients []Client, env stri
 			task.Input = os.Stdin
 		}
 
-		switch {
-		case cmd.Once:
-			task.Clients = []Client{clients[0]}
-			tasks = append(tasks, &task)
-		case cmd.Serial > 0:
-			// Each "serial" task client group is executed sequentially.
-			for i := 0; i < len(clients); i += cmd.Serial {
-				j := i + cmd.Serial
-				if j > len(clients) {
-					j = len(clients)
-				}
-
-				taskCopy := task
-				taskCopy.Clients = clients[i:j]
-				tasks = append(tasks, &taskCopy)
-			}
-		default:
-			task.Clients = clients
-			tasks = append(tasks, &task)
-		}
+		tasks = append(tasks, sup.distribute(&task, cmd, clients)...)
 	}
 
 	// Local command.
@@ -126,9 +119,18 @@ func (sup *Stackup) createTasks(cmd *command.Command, clients []Client, env stri
 		}
 
 		task := &Task{
+			Name:    cmd.Name,
 			Run:     cmd.Local,
 			Clients: []Client{local},
 			TTY:     true,
+			Local:   true,
+			Tunnels: tunnels,
+			Stream:  cmd.Stream,
+		}
+
+		// Tunnels of the local command lead to the first host.
+		if len(tunnels) > 0 && len(clients) > 0 {
+			task.Via = clients[0]
 		}
 
 		if sup.debug {
@@ -145,8 +147,12 @@ func (sup *Stackup) createTasks(cmd *command.Command, clients []Client, env stri
 	// Remote command.
 	if cmd.Run != "" {
 		task := Task{
-			Run: cmd.Run,
-			TTY: true,
+			Name:         cmd.Name,
+			Run:          cmd.Run,
+			TTY:          cmd.UseTTY(),
+			ForwardAgent: cmd.ForwardAgent,
+			Tunnels:      tunnels,
+			Stream:       cmd.Stream,
 		}
 		if sup.debug {
 			task.Run = debugRun + task.Run
@@ -156,31 +162,90 @@ func (sup *Stackup) createTasks(cmd *command.Command, clients []Client, env stri
 			task.Input = os.Stdin
 		}
 
-		switch {
-		case cmd.Once:
-			task.Clients = []Client{clients[0]}
-			tasks = append(tasks, &task)
-		case cmd.Serial > 0:
-			// Each "serial" task client group is executed sequentially.
-			for i := 0; i < len(clients); i += cmd.Serial {
-				j := i + cmd.Serial
-				if j > len(clients) {
-					j = len(clients)
-				}
+		tasks = append(tasks, sup.distribute(&task, cmd, clients)...)
+	}
 
-				taskCopy := task
-				taskCopy.Clients = clients[i:j]
-				tasks = append(tasks, &taskCopy)
-			}
-		default:
-			task.Clients = clients
-			tasks = append(tasks, &task)
+	// Download. Each host sends the remote path as a tar stream,
+	// which is extracted locally into the host's subdirectory.
+	for _, download := range cmd.Download {
+		dst, err := ResolveLocalPath(cwd, download.Dst, env)
+		if err != nil {
+			return nil, errors.Join(err, errors.New("download: "+download.Dst))
+		}
+
+		task := Task{
+			Name:     cmd.Name,
+			Run:      remotetar.RemoteTarCreateCommand(download.Src),
+			TTY:      false,
+			Download: &command.Download{Src: download.Src, Dst: dst},
 		}
+
+		tasks = append(tasks, sup.distribute(&task, cmd, clients)...)
+	}
+
+	// Each task of the command is limited by the command's timeout
+	// and ignores its errors if the command does.
+	timeout := cmd.Timeout
+	if timeout == 0 {
+		timeout = sup.timeout
+	}
+
+	for _, task := range tasks {
+		task.Timeout = timeout
+		task.IgnoreErrors = cmd.IgnoreErrors
 	}
 
 	return tasks, nil
 }
 
+// downloadDir returns the local directory the client's downloaded files
+// are extracted to, named after the host alias or address.
+func downloadDir(task *Task, c Client) string {
+	return filepath.Join(task.Download.Dst, hostName(c))
+}
+
+// distribute assigns clients to the task, according to the command's
+// "once" and "serial" settings. The input stream is shared by all the task's
+// clients, so the tasks reading it are split into batches of max_parallel
+// hosts rather than waiting for a free slot.
+func (sup *Stackup) distribute(task *Task, cmd *command.Command, clients []Client) []*Task {
+	size := cmd.Serial
+
+	hasInput := task.Upload != nil || task.Input != nil
+	if hasInput && sup.parallel > 0 && (size == 0 || size > sup.parallel) {
+		size = sup.parallel
+	}
+
+	switch {
+	case cmd.Once:
+		task.Clients = []Client{clients[0]}
+		return []*Task{task}
+	case size > 0:
+		var tasks []*Task
+
+		batches := (len(clients) + size - 1) / size
+
+		// Each batch of task clients is executed sequentially.
+		for i := 0; i < len(clients); i += size {
+			j := i + size
+			if j > len(clients) {
+				j = len(clients)
+			}
+
+			taskCopy := *task
+			taskCopy.Clients = clients[i:j]
+			taskCopy.Batch = len(tasks) + 1
+			taskCopy.Batches = batches
+			tasks = append(tasks, &taskCopy)
+		}
+
+		return tasks
+	default:
+		task.Clients = clients
+		return []*Task{task}
+	}
+}
+
 type ErrTask struct {
 	Task   *Task
 	Reason string
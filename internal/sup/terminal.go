@@ -0,0 +1,39 @@
+package sup
+
+import (
+	"os"
+
+	"golang.org/x/term"
+)
+
+// Size of the remote pseudo terminal, if sup doesn't run in a terminal.
+const (
+	defaultTerminalWidth  = 80
+	defaultTerminalHeight = 40
+)
+
+// terminalSize returns the size of the local terminal sup writes to.
+func terminalSize() (width, height int) {
+	for _, f := range []*os.File{os.Stdout, os.Stderr, os.Stdin} {
+		if width, height, err := term.GetSize(int(f.Fd())); err == nil && width > 0 && height > 0 {
+			return width, height
+		}
+	}
+
+	return defaultTerminalWidth, defaultTerminalHeight
+}
+
+// terminalType returns the local terminal type, xterm by default.
+func terminalType() string {
+	if t := os.Getenv("TERM"); t != "" && t != "dumb" {
+		return t
+	}
+
+	return "xterm"
+}
+
+// interactive reports whether sup reads from a terminal, ie. the commands
+// may prompt the user on it.
+func interactive() bool {
+	return term.IsTerminal(int(os.Stdin.Fd()))
+}
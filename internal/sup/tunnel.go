@@ -0,0 +1,255 @@
+package sup
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/DTreshy/sup/internal/command"
+	"github.com/DTreshy/sup/internal/network"
+)
+
+// tunnelNetwork is the side of a tunnel, ie. the SSH connection to the host.
+type tunnelNetwork interface {
+	Dial(n, addr string) (net.Conn, error)
+	Listen(n, addr string) (net.Listener, error)
+}
+
+// localNetwork is the localhost side of the tunnels.
+type localNetwork struct{}
+
+func (localNetwork) Dial(n, addr string) (net.Conn, error) {
+	return net.Dial(n, addr)
+}
+
+func (localNetwork) Listen(n, addr string) (net.Listener, error) {
+	return net.Listen(n, addr)
+}
+
+// remoteNetwork returns the network of the client the tunnels lead to.
+// Tunnels of the localhost "host" stay on localhost.
+func remoteNetwork(c Client) tunnelNetwork {
+	if c, ok := c.(*SSHClient); ok {
+		return c.conn
+	}
+
+	return localNetwork{}
+}
+
+// checkTunnels rejects the commands whose local forwardings would listen
+// on the same local port more than once at a time, ie. a fixed port of
+// a command running on multiple hosts at once.
+func checkTunnels(tunnels []network.Tunnel, hosts, parallel int, commands []*command.Command) error {
+	for _, cmd := range commands {
+		specs := append(append([]network.Tunnel{}, tunnels...), cmd.Tunnels...)
+
+		// The local command runs once, before the remote one.
+		if cmd.Local != "" {
+			if err := checkPorts(cmd.Name, specs, 1); err != nil {
+				return err
+			}
+		}
+
+		if cmd.Run == "" && cmd.Script == "" {
+			continue
+		}
+
+		concurrent := hosts
+
+		switch {
+		case cmd.Once:
+			concurrent = 1
+		case cmd.Serial > 0 && cmd.Serial < concurrent:
+			concurrent = cmd.Serial
+		}
+
+		if parallel > 0 && parallel < concurrent {
+			concurrent = parallel
+		}
+
+		if err := checkPorts(cmd.Name, specs, concurrent); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkPorts rejects the local ports the tunnels of the tasks running
+// on the given number of hosts at once would listen on more than once.
+// The hosts listen on their own ports of the reverse tunnels.
+func checkPorts(name string, specs []network.Tunnel, concurrent int) error {
+	binds := map[string]int{}
+
+	for _, spec := range specs {
+		if spec.Reverse {
+			continue
+		}
+
+		_, port, _ := net.SplitHostPort(spec.Listen)
+		if port == "0" {
+			continue
+		}
+
+		binds[port] += concurrent
+
+		switch {
+		case binds[port] <= 1:
+		case concurrent > 1:
+			return fmt.Errorf("%v: tunnel %v would listen on the same local port for %v hosts at once, use port 0 or serial: 1", name, spec, concurrent)
+		default:
+			return fmt.Errorf("%v: tunnel %v would listen on the local port of another tunnel", name, spec)
+		}
+	}
+
+	return nil
+}
+
+// tunnels are the forwardings open while a task runs.
+type tunnels struct {
+	mu        sync.Mutex
+	listeners []net.Listener
+	conns     map[net.Conn]bool
+	closed    bool
+}
+
+// openTunnels starts listening on the tunnels' ports. It returns the exports
+// of the bound ports, to be prepended to the task's command.
+func openTunnels(remote tunnelNetwork, specs []network.Tunnel) (*tunnels, string, error) {
+	t := &tunnels{conns: map[net.Conn]bool{}}
+
+	var env string
+
+	for _, spec := range specs {
+		var listenOn, connectFrom tunnelNetwork = localNetwork{}, remote
+		if spec.Reverse {
+			listenOn, connectFrom = remote, localNetwork{}
+		}
+
+		listener, err := listenOn.Listen("tcp", spec.Listen)
+		if err != nil {
+			t.Close()
+			return nil, "", errors.Join(err, fmt.Errorf("tunnel %v failed", spec))
+		}
+
+		t.listeners = append(t.listeners, listener)
+
+		if spec.Env != "" {
+			_, port, _ := net.SplitHostPort(listener.Addr().String())
+			env += fmt.Sprintf("export %v=%v;", spec.Env, strconv.Quote(port))
+		}
+
+		go t.serve(listener, connectFrom, spec.Connect)
+	}
+
+	return t, env, nil
+}
+
+// serve forwards the accepted connections to the address.
+func (t *tunnels) serve(listener net.Listener, connectFrom tunnelNetwork, addr string) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go t.forward(conn, connectFrom, addr)
+	}
+}
+
+func (t *tunnels) forward(conn net.Conn, connectFrom tunnelNetwork, addr string) {
+	defer conn.Close()
+
+	target, err := connectFrom.Dial("tcp", addr)
+	if err != nil {
+		return
+	}
+	defer target.Close()
+
+	if !t.track(conn, target) {
+		return
+	}
+	defer t.untrack(conn, target)
+
+	// Each side done sending half-closes the other one, the forwarding ends
+	// once both are done.
+	var wg sync.WaitGroup
+
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+
+		_, _ = io.Copy(target, conn)
+		closeWrite(target)
+	}()
+
+	go func() {
+		defer wg.Done()
+
+		_, _ = io.Copy(conn, target)
+		closeWrite(conn)
+	}()
+
+	wg.Wait()
+}
+
+// closeWrite shuts down the writing side of the connection, or closes it
+// if it can't be half-closed.
+func closeWrite(conn net.Conn) {
+	if c, ok := conn.(interface{ CloseWrite() error }); ok {
+		_ = c.CloseWrite()
+		return
+	}
+
+	_ = conn.Close()
+}
+
+// track registers the forwarded connections, to be closed with the tunnels.
+// It reports false if the tunnels are closed already.
+func (t *tunnels) track(conns ...net.Conn) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return false
+	}
+
+	for _, conn := range conns {
+		t.conns[conn] = true
+	}
+
+	return true
+}
+
+func (t *tunnels) untrack(conns ...net.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, conn := range conns {
+		delete(t.conns, conn)
+	}
+}
+
+// Close stops listening and closes the forwarded connections.
+func (t *tunnels) Close() {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.closed = true
+
+	for _, listener := range t.listeners {
+		listener.Close()
+	}
+
+	for conn := range t.conns {
+		conn.Close()
+	}
+}
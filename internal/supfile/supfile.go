@@ -21,6 +21,7 @@ type Supfile struct {
 	Commands command.Commands `yaml:"commands"`
 	Targets  target.Targets   `yaml:"targets"`
 	Env      envs.EnvList     `yaml:"env"`
+	Prefix   string           `yaml:"prefix"` // Template of the output prefix, see Stackup.PrefixFormat.
 	Version  string           `yaml:"version"`
 }
 
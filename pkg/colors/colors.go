@@ -1,5 +1,11 @@
 package colors
 
+import (
+	"os"
+
+	"golang.org/x/term"
+)
+
 var (
 	Colors = []string{
 		"\033[32m", // green
@@ -11,3 +17,22 @@ var (
 	}
 	ResetColor = "\033[0m"
 )
+
+// Supported reports whether the output to f should be colored, ie. f is
+// a terminal and NO_COLOR (https://no-color.org) isn't set.
+func Supported(f *os.File) bool {
+	if os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+
+	return term.IsTerminal(int(f.Fd()))
+}
+
+// Disable turns the colors into empty strings.
+func Disable() {
+	for i := range Colors {
+		Colors[i] = ""
+	}
+
+	ResetColor = ""
+}
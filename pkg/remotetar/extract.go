@@ -0,0 +1,176 @@
+package remotetar
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Copying dirs/files from the remote host works the other way around:
+// ssh $HOST "tar -C $(dirname $SRC) -czf - $(basename $SRC)"
+// and the TAR stream is extracted locally.
+
+// RemoteTarCreateCommand returns command to be run on remote SSH host
+// to send the remote path as a TAR stream to STDOUT.
+func RemoteTarCreateCommand(src string) string {
+	src = strings.TrimRight(src, "/")
+	if src == "" {
+		src = "/"
+	}
+
+	return fmt.Sprintf("tar -C %q -czf - %q", path.Dir(src), path.Base(src))
+}
+
+// Extract extracts the gzipped tar stream into the local dst directory.
+// Entries that would end up outside of dst are rejected. Empty stream
+// is not an error; the remote command's exit status tells what happened.
+func Extract(r io.Reader, dst string) error {
+	gz, err := gzip.NewReader(r)
+	if err == io.EOF {
+		return nil
+	}
+
+	if err != nil {
+		return errors.Join(err, errors.New("tar: reading stream failed"))
+	}
+
+	if err := os.MkdirAll(dst, 0o755); err != nil {
+		return err
+	}
+
+	tr := tar.NewReader(gz)
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return errors.Join(err, errors.New("tar: reading stream failed"))
+		}
+
+		if err := extractEntry(tr, header, dst); err != nil {
+			return errors.Join(err, fmt.Errorf("tar: extracting %v failed", header.Name))
+		}
+	}
+}
+
+func extractEntry(tr *tar.Reader, header *tar.Header, dst string) error {
+	name := filepath.FromSlash(path.Clean(header.Name))
+	if name == "." {
+		return nil
+	}
+
+	if !isLocal(name) {
+		return errors.New("path is outside of the destination")
+	}
+
+	// Don't write through the symlinks, ie. extracted earlier from the same
+	// stream, the path could lead outside of dst.
+	if err := checkParents(dst, name); err != nil {
+		return err
+	}
+
+	target := filepath.Join(dst, name)
+	mode := header.FileInfo().Mode().Perm()
+
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return err
+	}
+
+	// Replace the link left by the previous download, or earlier in the stream.
+	if info, err := os.Lstat(target); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		if err := os.Remove(target); err != nil {
+			return err
+		}
+	}
+
+	switch header.Typeflag {
+	case tar.TypeDir:
+		if err := os.MkdirAll(target, mode|0o700); err != nil {
+			return err
+		}
+	case tar.TypeReg:
+		f, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+		if err != nil {
+			return err
+		}
+
+		if _, err := io.Copy(f, tr); err != nil {
+			f.Close()
+			return err
+		}
+
+		if err := f.Close(); err != nil {
+			return err
+		}
+
+		if err := os.Chmod(target, mode); err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		// The link must point inside of dst, relative to the link itself.
+		link := filepath.FromSlash(header.Linkname)
+		if filepath.IsAbs(link) || !isLocal(filepath.Join(filepath.Dir(name), link)) {
+			return fmt.Errorf("symlink to %v is outside of the destination", header.Linkname)
+		}
+
+		if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		return os.Symlink(header.Linkname, target)
+	default:
+		// Devices, FIFOs and hard links are not supported.
+		return nil
+	}
+
+	return os.Chtimes(target, header.ModTime, header.ModTime)
+}
+
+// isLocal reports whether the relative path stays within its base directory.
+func isLocal(name string) bool {
+	name = filepath.Clean(name)
+
+	return !filepath.IsAbs(name) && name != ".." && !strings.HasPrefix(name, ".."+string(filepath.Separator))
+}
+
+// checkParents fails if any existing parent directory of the name within dst
+// is a symlink, or not a directory.
+func checkParents(dst, name string) error {
+	dir := dst
+
+	for _, part := range strings.Split(filepath.Dir(name), string(filepath.Separator)) {
+		if part == "." {
+			break
+		}
+
+		dir = filepath.Join(dir, part)
+
+		info, err := os.Lstat(dir)
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("path leads through symlink %v", dir)
+		}
+
+		if !info.IsDir() {
+			return fmt.Errorf("%v is not a directory", dir)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,137 @@
+package remotetar
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// entry is a tar stream entry, a symlink if link is set.
+type entry struct {
+	name string
+	link string
+	data string
+}
+
+func newStream(t *testing.T, entries ...entry) *bytes.Buffer {
+	t.Helper()
+
+	var buf bytes.Buffer
+
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+
+	for _, e := range entries {
+		header := &tar.Header{Name: e.name, Mode: 0o644, Typeflag: tar.TypeReg, Size: int64(len(e.data))}
+		if e.link != "" {
+			header = &tar.Header{Name: e.name, Mode: 0o777, Typeflag: tar.TypeSymlink, Linkname: e.link}
+		}
+
+		require.NoError(t, tw.WriteHeader(header))
+
+		_, err := tw.Write([]byte(e.data))
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, tw.Close())
+	require.NoError(t, gz.Close())
+
+	return &buf
+}
+
+func TestExtract(t *testing.T) {
+	dst := t.TempDir()
+
+	err := Extract(newStream(t,
+		entry{name: "app/config.yml", data: "a: 1\n"},
+		entry{name: "app/current", link: "config.yml"},
+	), dst)
+	require.NoError(t, err)
+
+	data, err := os.ReadFile(filepath.Join(dst, "app", "current"))
+	require.NoError(t, err)
+	require.Equal(t, "a: 1\n", string(data))
+}
+
+func TestExtractOutsideOfDestination(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries func(outside string) []entry
+	}{
+		{
+			name: "parent path",
+			entries: func(string) []entry {
+				return []entry{{name: "../x", data: "pwned"}}
+			},
+		},
+		{
+			name: "absolute symlink",
+			entries: func(outside string) []entry {
+				return []entry{{name: "evil", link: outside}, {name: "evil/x", data: "pwned"}}
+			},
+		},
+		{
+			name: "relative symlink",
+			entries: func(string) []entry {
+				return []entry{{name: "dir/evil", link: "../../outside"}, {name: "dir/evil/x", data: "pwned"}}
+			},
+		},
+		{
+			name: "file through symlinked dir",
+			entries: func(outside string) []entry {
+				return []entry{{name: "evil", link: "."}, {name: "evil/../../x", data: "pwned"}}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			dst := filepath.Join(root, "dst")
+			outside := filepath.Join(root, "outside")
+
+			require.NoError(t, os.Mkdir(outside, 0o755))
+
+			err := Extract(newStream(t, tt.entries(outside)...), dst)
+			require.Error(t, err)
+
+			for _, file := range []string{filepath.Join(root, "x"), filepath.Join(outside, "x")} {
+				_, err = os.Stat(file)
+				require.True(t, os.IsNotExist(err), file)
+			}
+		})
+	}
+}
+
+// Symlinks already in dst, ie. from the previous download, aren't followed.
+func TestExtractThroughExistingSymlink(t *testing.T) {
+	root := t.TempDir()
+	dst := filepath.Join(root, "dst")
+	outside := filepath.Join(root, "outside")
+
+	require.NoError(t, os.MkdirAll(dst, 0o755))
+	require.NoError(t, os.Mkdir(outside, 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(outside, "x"), []byte("keep"), 0o644))
+	require.NoError(t, os.Symlink(outside, filepath.Join(dst, "evil")))
+	require.NoError(t, os.Symlink(filepath.Join(outside, "x"), filepath.Join(dst, "file")))
+
+	err := Extract(newStream(t, entry{name: "evil/x", data: "pwned"}), dst)
+	require.Error(t, err)
+
+	// The link is replaced by the file, not written through.
+	err = Extract(newStream(t, entry{name: "file", data: "new"}), dst)
+	require.NoError(t, err)
+
+	data, err := os.ReadFile(filepath.Join(outside, "x"))
+	require.NoError(t, err)
+	require.Equal(t, "keep", string(data))
+
+	info, err := os.Lstat(filepath.Join(dst, "file"))
+	require.NoError(t, err)
+	require.True(t, info.Mode().IsRegular())
+}
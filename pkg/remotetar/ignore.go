@@ -0,0 +1,196 @@
+package remotetar
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// IgnoreFile is read from the root of every uploaded directory.
+const IgnoreFile = ".supignore"
+
+// Ignore matches paths against .gitignore-style patterns:
+//
+//   - "#" starts a comment, "!" negates the pattern,
+//   - a trailing "/" matches directories only,
+//   - a pattern with "/" in the beginning or middle is relative to the root,
+//     otherwise it matches the name at any depth,
+//   - "*" and "?" don't match "/", "**" matches any number of directories.
+//
+// The last matching pattern decides.
+type Ignore struct {
+	patterns []pattern
+}
+
+type pattern struct {
+	expr    *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// NewIgnore compiles the patterns.
+func NewIgnore(patterns ...string) (*Ignore, error) {
+	ignore := &Ignore{}
+
+	for _, p := range patterns {
+		if err := ignore.add(p); err != nil {
+			return nil, err
+		}
+	}
+
+	return ignore, nil
+}
+
+// ReadIgnoreFile adds patterns from the file, one per line.
+// Missing file is not an error.
+func (i *Ignore) ReadIgnoreFile(file string) error {
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if err := i.add(scanner.Text()); err != nil {
+			return fmt.Errorf("%v: %w", file, err)
+		}
+	}
+
+	return scanner.Err()
+}
+
+func (i *Ignore) add(line string) error {
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil
+	}
+
+	var p pattern
+
+	if strings.HasPrefix(line, "!") {
+		p.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\`) {
+		line = line[1:] // Escaped "#" or "!".
+	}
+
+	if strings.HasSuffix(line, "/") {
+		p.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+
+	anchored := strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+
+	if line == "" {
+		return nil
+	}
+
+	expr := globToRegexp(line)
+	if !anchored {
+		expr = "(?:.*/)?" + expr
+	}
+
+	var err error
+
+	p.expr, err = regexp.Compile("^" + expr + "$")
+	if err != nil {
+		return fmt.Errorf("invalid exclude pattern %q: %w", line, err)
+	}
+
+	i.patterns = append(i.patterns, p)
+
+	return nil
+}
+
+// Match reports whether the slash separated path, relative to the root,
+// should be ignored. Paths inside ignored directories are ignored too.
+func (i *Ignore) Match(name string, isDir bool) bool {
+	if len(i.patterns) == 0 {
+		return false
+	}
+
+	// Once a parent directory is excluded, nothing inside can be re-included.
+	for dir := path.Dir(name); dir != "." && dir != "/"; dir = path.Dir(dir) {
+		if i.match(dir, true) {
+			return true
+		}
+	}
+
+	return i.match(name, isDir)
+}
+
+func (i *Ignore) match(name string, isDir bool) bool {
+	ignored := false
+
+	for _, p := range i.patterns {
+		if p.dirOnly && !isDir {
+			continue
+		}
+
+		if p.expr.MatchString(name) {
+			ignored = !p.negate
+		}
+	}
+
+	return ignored
+}
+
+// globToRegexp translates the glob pattern into a regular expression.
+func globToRegexp(glob string) string {
+	var expr strings.Builder
+
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				i++
+
+				switch {
+				case i+1 < len(glob) && glob[i+1] == '/':
+					i++
+					expr.WriteString("(?:.*/)?") // "**/" matches zero or more directories.
+				default:
+					expr.WriteString(".*")
+				}
+
+				continue
+			}
+
+			expr.WriteString("[^/]*")
+		case '?':
+			expr.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				expr.WriteString(`\[`)
+				continue
+			}
+
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+
+			expr.WriteString("[" + class + "]")
+			i += end + 1
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+				expr.WriteString(regexp.QuoteMeta(string(glob[i])))
+			}
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	return expr.String()
+}
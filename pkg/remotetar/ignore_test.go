@@ -0,0 +1,79 @@
+package remotetar
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIgnoreMatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		patterns []string
+		path     string
+		isDir    bool
+		want     bool
+	}{
+		{name: "no patterns", path: "main.go", want: false},
+		{name: "comment", patterns: []string{"# main.go"}, path: "main.go", want: false},
+		{name: "escaped comment", patterns: []string{`\#main.go`}, path: "#main.go", want: true},
+
+		{name: "name at root", patterns: []string{"*.log"}, path: "debug.log", want: true},
+		{name: "name at any depth", patterns: []string{"*.log"}, path: "var/log/debug.log", want: true},
+		{name: "star doesn't match slash", patterns: []string{"var/*.log"}, path: "var/log/debug.log", want: false},
+		{name: "question mark", patterns: []string{"debug.?og"}, path: "debug.log", want: true},
+		{name: "character class", patterns: []string{"debug[0-9].log"}, path: "debug1.log", want: true},
+		{name: "negated character class", patterns: []string{"debug[!0-9].log"}, path: "debug1.log", want: false},
+
+		{name: "leading slash anchors", patterns: []string{"/build"}, path: "build", want: true},
+		{name: "leading slash anchors, nested", patterns: []string{"/build"}, path: "src/build", want: false},
+		{name: "middle slash anchors", patterns: []string{"docs/*.md"}, path: "docs/index.md", want: true},
+		{name: "middle slash anchors, nested", patterns: []string{"docs/*.md"}, path: "src/docs/index.md", want: false},
+
+		{name: "leading double star", patterns: []string{"**/testdata"}, path: "a/b/testdata", isDir: true, want: true},
+		{name: "leading double star at root", patterns: []string{"**/testdata"}, path: "testdata", isDir: true, want: true},
+		{name: "trailing double star", patterns: []string{"vendor/**"}, path: "vendor/a/b.go", want: true},
+		{name: "trailing double star, dir itself", patterns: []string{"vendor/**"}, path: "vendor", isDir: true, want: false},
+		{name: "middle double star", patterns: []string{"a/**/b"}, path: "a/x/y/b", want: true},
+		{name: "middle double star, no dirs", patterns: []string{"a/**/b"}, path: "a/b", want: true},
+
+		{name: "dir only matches dir", patterns: []string{"tmp/"}, path: "tmp", isDir: true, want: true},
+		{name: "dir only skips file", patterns: []string{"tmp/"}, path: "tmp", want: false},
+		{name: "dir only, contents", patterns: []string{"tmp/"}, path: "src/tmp/cache.bin", want: true},
+
+		{name: "negation", patterns: []string{"*.log", "!keep.log"}, path: "keep.log", want: false},
+		{name: "negation, others ignored", patterns: []string{"*.log", "!keep.log"}, path: "debug.log", want: true},
+		{name: "last pattern decides", patterns: []string{"!keep.log", "*.log"}, path: "keep.log", want: true},
+		{name: "negation of dir contents", patterns: []string{"logs/*", "!logs/keep.log"}, path: "logs/keep.log", want: false},
+		{name: "excluded dir can't be re-included", patterns: []string{"logs", "!logs/keep.log"}, path: "logs/keep.log", want: true},
+		{name: "escaped negation", patterns: []string{`\!important`}, path: "!important", want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ignore, err := NewIgnore(tt.patterns...)
+			require.NoError(t, err)
+			require.Equal(t, tt.want, ignore.Match(tt.path, tt.isDir))
+		})
+	}
+}
+
+func TestReadIgnoreFile(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, IgnoreFile)
+
+	require.NoError(t, os.WriteFile(file, []byte("# Build output\n/bin/\n\n*.tmp  \n!keep.tmp\n"), 0o644))
+
+	ignore, err := NewIgnore(".git")
+	require.NoError(t, err)
+	require.NoError(t, ignore.ReadIgnoreFile(file))
+	require.NoError(t, ignore.ReadIgnoreFile(filepath.Join(dir, "missing")))
+
+	require.True(t, ignore.Match(".git", true))
+	require.True(t, ignore.Match("bin/sup", false))
+	require.False(t, ignore.Match("cmd/bin", false))
+	require.True(t, ignore.Match("a/b.tmp", false))
+	require.False(t, ignore.Match("a/keep.tmp", false))
+}
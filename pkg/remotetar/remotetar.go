@@ -1,56 +1,223 @@
 package remotetar
 
 import (
+	"archive/tar"
+	"compress/gzip"
 	"errors"
 	"fmt"
 	"io"
-	"os/exec"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
 	"strings"
+	"sync"
 )
 
 // Copying dirs/files over SSH using TAR.
-// tar -C . -cvzf - $SRC | ssh $HOST "tar -C $DST -xvzf -"
+// The TAR stream is created locally and piped to the remote host:
+// ssh $HOST "tar -C $DST -xzf -"
 
 // RemoteTarCommand returns command to be run on remote SSH host
 // to properly receive the created TAR stream.
 // TODO: Check for relative directory.
 func RemoteTarCommand(dir string) string {
-	return fmt.Sprintf("tar -C \"%q\" -xzf -", dir)
+	return fmt.Sprintf("tar -C %q -xzf -", dir)
 }
 
-func LocalTarCmdArgs(path, exclude string) []string {
-	args := []string{}
+// Excludes splits the comma separated list of exclude patterns.
+func Excludes(exclude string) []string {
+	var patterns []string
 
-	// Added pattens to exclude from tar compress
-	excludes := strings.Split(exclude, ",")
-
-	for _, exclude := range excludes {
-		trimmed := strings.TrimSpace(exclude)
+	for _, pattern := range strings.Split(exclude, ",") {
+		trimmed := strings.TrimSpace(pattern)
 		if trimmed != "" {
-			args = append(args, `--exclude=`+trimmed)
+			patterns = append(patterns, trimmed)
 		}
 	}
 
-	args = append(args, "-C", ".", "-czf", "-", path)
-
-	return args
+	return patterns
 }
 
-// NewTarStreamReader creates a tar stream reader from a local path.
-// TODO: Refactor. Use "archive/tar" instead.
+// NewTarStreamReader creates a gzipped tar stream reader from a local path,
+// relative to cwd. The exclude patterns, as well as the patterns from
+// .supignore file of the uploaded directory, are matched relative to the path.
+// The archive is built only once the stream is read; errors that happen
+// meanwhile are returned from Read.
 func NewTarStreamReader(cwd, path, exclude string) (io.Reader, error) {
-	localTarCmdArgs := LocalTarCmdArgs(path, exclude)
-	cmd := exec.Command("tar", localTarCmdArgs...)
-	cmd.Dir = cwd
+	archive, err := newArchive(cwd, path, exclude)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tarStream{archive: archive}, nil
+}
+
+// ListFiles returns names of the entries that the tar stream created
+// from a local path would contain, in the same order.
+func ListFiles(cwd, path, exclude string) ([]string, error) {
+	archive, err := newArchive(cwd, path, exclude)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+
+	err = archive.walk(func(name, _ string, _ fs.FileInfo) error {
+		files = append(files, name)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+// archive is a set of local files to be sent.
+type archive struct {
+	root   string // Local path of the uploaded file or directory.
+	name   string // Name of the root in the archive.
+	ignore *Ignore
+}
+
+func newArchive(cwd, path, exclude string) (*archive, error) {
+	root := path
+	if !filepath.IsAbs(root) {
+		root = filepath.Join(cwd, root)
+	}
+
+	info, err := os.Lstat(root)
+	if err != nil {
+		return nil, errors.Join(err, errors.New("tar: can't read upload source"))
+	}
+
+	ignore, err := NewIgnore(Excludes(exclude)...)
+	if err != nil {
+		return nil, errors.Join(err, errors.New("tar: parsing exclude patterns failed"))
+	}
+
+	if info.IsDir() {
+		if err := ignore.ReadIgnoreFile(filepath.Join(root, IgnoreFile)); err != nil {
+			return nil, errors.Join(err, errors.New("tar: reading "+IgnoreFile+" failed"))
+		}
+	}
+
+	// Keep the path as given, like tar does, without the leading "/".
+	name := strings.TrimLeft(filepath.ToSlash(filepath.Clean(path)), "/")
+	if name == "" {
+		name = "."
+	}
+
+	return &archive{root: root, name: name, ignore: ignore}, nil
+}
+
+// walk calls fn for every non-excluded file, in lexical order.
+func (a *archive) walk(fn func(name, file string, info fs.FileInfo) error) error {
+	return filepath.WalkDir(a.root, func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
 
-	stdout, err := cmd.StdoutPipe()
+		rel, err := filepath.Rel(a.root, file)
+		if err != nil {
+			return err
+		}
+
+		rel = filepath.ToSlash(rel)
+
+		if rel != "." && a.ignore.Match(rel, d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		name := path.Join(a.name, rel)
+		if d.IsDir() {
+			name += "/"
+		}
+
+		return fn(name, file, info)
+	})
+}
+
+// write writes the gzipped archive to w.
+func (a *archive) write(w io.Writer) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	err := a.walk(func(name, file string, info fs.FileInfo) error {
+		var link string
+
+		if info.Mode()&fs.ModeSymlink != 0 {
+			target, err := os.Readlink(file)
+			if err != nil {
+				return err
+			}
+
+			link = target
+		}
+
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+
+		header.Name = name
+
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		_, err = io.Copy(tw, f)
+
+		return err
+	})
 	if err != nil {
-		return nil, errors.Join(err, errors.New("tar: stdout pipe failed"))
+		return errors.Join(err, errors.New("tar: creating archive failed"))
 	}
 
-	if err := cmd.Start(); err != nil {
-		return nil, errors.Join(err, errors.New("tar: starting cmd failed"))
+	if err := tw.Close(); err != nil {
+		return err
 	}
 
-	return stdout, nil
+	return gz.Close()
+}
+
+// tarStream starts writing the archive on its first Read.
+type tarStream struct {
+	archive *archive
+	once    sync.Once
+	reader  *io.PipeReader
+}
+
+func (s *tarStream) Read(p []byte) (int, error) {
+	s.once.Do(func() {
+		var writer *io.PipeWriter
+
+		s.reader, writer = io.Pipe()
+
+		go func() {
+			writer.CloseWithError(s.archive.write(writer))
+		}()
+	})
+
+	return s.reader.Read(p)
 }
@@ -0,0 +1,429 @@
+// Package sshconfig reads OpenSSH client configuration files, ie. ~/.ssh/config.
+//
+// Only the directives relevant for sup are interpreted, the rest are ignored.
+// As in OpenSSH, the first obtained value of each directive wins, except for
+// IdentityFile, which accumulates.
+package sshconfig
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Host is the configuration of a single host.
+type Host struct {
+	HostName            string
+	User                string
+	Port                int
+	IdentityFiles       []string
+	IdentitiesOnly      bool
+	ForwardAgent        bool
+	ProxyJump           []string // Jump hosts in the order of connecting, nil for none.
+	ServerAliveInterval time.Duration
+	ServerAliveCountMax int
+	ConnectTimeout      time.Duration
+	ConnectionAttempts  int
+}
+
+// Config is a parsed ssh_config file, including the files it includes.
+type Config struct {
+	blocks []*block
+}
+
+// block is a Host or Match section. Options of an included file are in blocks
+// of their own, applied only when the block of the Include directive applies.
+type block struct {
+	parent   *block
+	hosts    []string // Host patterns.
+	criteria []string // Match criteria, as keyword-argument pairs.
+	options  [][2]string
+	file     string
+	line     int
+}
+
+// Load reads the ssh_config file.
+func Load(file string) (*Config, error) {
+	config := &Config{}
+
+	if err := config.include(file, nil, 0); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// Parse reads ssh_config from r. Include directives are resolved
+// relative to ~/.ssh.
+func Parse(r io.Reader) (*Config, error) {
+	config := &Config{}
+
+	if err := config.parse(r, "ssh_config", nil, 0); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// include parses the file and appends its blocks to the config.
+func (c *Config) include(file string, parent *block, depth int) error {
+	if depth > 16 {
+		return fmt.Errorf("%v: too many nested includes", file)
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return c.parse(f, file, parent, depth)
+}
+
+func (c *Config) parse(r io.Reader, file string, parent *block, depth int) error {
+	// Options before the first Host or Match apply to all hosts.
+	current := &block{parent: parent, file: file}
+	c.blocks = append(c.blocks, current)
+
+	scanner := bufio.NewScanner(r)
+
+	for line := 1; scanner.Scan(); line++ {
+		keyword, args, err := splitLine(scanner.Text())
+		if err != nil {
+			return fmt.Errorf("%v:%v: %w", file, line, err)
+		}
+
+		if keyword == "" {
+			continue
+		}
+
+		switch keyword {
+		case "host":
+			if len(args) == 0 {
+				return fmt.Errorf("%v:%v: Host requires at least one pattern", file, line)
+			}
+
+			current = &block{parent: parent, hosts: args, file: file, line: line}
+			c.blocks = append(c.blocks, current)
+		case "match":
+			if len(args) == 0 {
+				return fmt.Errorf("%v:%v: Match requires criteria", file, line)
+			}
+
+			current = &block{parent: parent, criteria: args, file: file, line: line}
+			c.blocks = append(c.blocks, current)
+		case "include":
+			for _, pattern := range args {
+				files, err := filepath.Glob(expandPath(pattern))
+				if err != nil {
+					return fmt.Errorf("%v:%v: %w", file, line, err)
+				}
+
+				for _, included := range files {
+					if err := c.include(included, current, depth+1); err != nil {
+						return err
+					}
+				}
+			}
+
+			// Options after the Include belong to the enclosing block again.
+			next := &block{parent: current.parent, hosts: current.hosts, criteria: current.criteria, file: file, line: line}
+			c.blocks = append(c.blocks, next)
+			current = next
+		default:
+			current.options = append(current.options, [2]string{keyword, strings.Join(args, " ")})
+		}
+	}
+
+	return scanner.Err()
+}
+
+// splitLine splits the line into lower case keyword and its arguments.
+func splitLine(line string) (string, []string, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", nil, nil
+	}
+
+	// Keyword is separated by whitespace or by "=".
+	end := strings.IndexAny(line, " \t=")
+	if end < 0 {
+		return strings.ToLower(line), nil, nil
+	}
+
+	keyword := strings.ToLower(line[:end])
+	rest := strings.TrimSpace(line[end:])
+	rest = strings.TrimSpace(strings.TrimPrefix(rest, "="))
+
+	var (
+		args   []string
+		arg    strings.Builder
+		quoted bool
+		inArg  bool
+	)
+
+	for _, r := range rest {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			inArg = true
+		case !quoted && (r == ' ' || r == '\t'):
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(r)
+			inArg = true
+		}
+	}
+
+	if quoted {
+		return "", nil, fmt.Errorf("unterminated quote in %q", line)
+	}
+
+	if inArg {
+		args = append(args, arg.String())
+	}
+
+	return keyword, args, nil
+}
+
+// Lookup returns the configuration of the host, as known to the caller
+// (ie. the alias, not the HostName). The user is used for Match user
+// criteria, if not overridden by the configuration itself.
+func (c *Config) Lookup(host, remoteUser string) Host {
+	var result Host
+
+	if c == nil {
+		return result
+	}
+
+	seen := map[string]bool{}
+	state := &matchState{originalHost: host, host: host, user: remoteUser}
+
+	applies := map[*block]bool{}
+
+	for _, b := range c.blocks {
+		if !c.applies(b, state, applies) {
+			continue
+		}
+
+		for _, option := range b.options {
+			keyword, value := option[0], option[1]
+
+			if keyword != "identityfile" && seen[keyword] {
+				continue
+			}
+
+			seen[keyword] = true
+
+			result.set(keyword, value, state)
+		}
+	}
+
+	return result
+}
+
+// applies reports whether the options of the block apply to the host.
+// The blocks are evaluated in order, so Match host sees the HostName set
+// by the preceding blocks.
+func (c *Config) applies(b *block, state *matchState, cache map[*block]bool) bool {
+	if ok, found := cache[b]; found {
+		return ok
+	}
+
+	ok := true
+	if b.parent != nil {
+		ok = c.applies(b.parent, state, cache)
+	}
+
+	switch {
+	case !ok:
+	case b.hosts != nil:
+		ok = matchList(b.hosts, state.originalHost)
+	case b.criteria != nil:
+		ok = state.match(b.criteria)
+	}
+
+	cache[b] = ok
+
+	return ok
+}
+
+// set stores the directive value, unless it's already set.
+func (h *Host) set(keyword, value string, state *matchState) {
+	switch keyword {
+	case "hostname":
+		h.HostName = expandTokens(value, state)
+		state.host = h.HostName
+	case "user":
+		h.User = value
+		state.user = value
+	case "port":
+		h.Port, _ = strconv.Atoi(value)
+	case "identityfile":
+		if strings.EqualFold(value, "none") {
+			return
+		}
+
+		h.IdentityFiles = append(h.IdentityFiles, expandPath(expandTokens(value, state)))
+	case "identitiesonly":
+		h.IdentitiesOnly = strings.EqualFold(value, "yes")
+	case "forwardagent":
+		h.ForwardAgent = strings.EqualFold(value, "yes")
+	case "proxyjump":
+		if strings.EqualFold(value, "none") {
+			h.ProxyJump = []string{}
+			return
+		}
+
+		for _, hop := range strings.Split(value, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				h.ProxyJump = append(h.ProxyJump, hop)
+			}
+		}
+	case "serveraliveinterval":
+		seconds, _ := strconv.Atoi(value)
+		h.ServerAliveInterval = time.Duration(seconds) * time.Second
+	case "serveralivecountmax":
+		h.ServerAliveCountMax, _ = strconv.Atoi(value)
+	case "connecttimeout":
+		seconds, _ := strconv.Atoi(value)
+		h.ConnectTimeout = time.Duration(seconds) * time.Second
+	case "connectionattempts":
+		h.ConnectionAttempts, _ = strconv.Atoi(value)
+	}
+}
+
+// matchState is the host being looked up, as resolved so far.
+type matchState struct {
+	originalHost string
+	host         string
+	user         string
+}
+
+// match evaluates Match criteria. Unsupported criteria never match.
+func (s *matchState) match(criteria []string) bool {
+	for i := 0; i < len(criteria); i++ {
+		criterion := strings.ToLower(criteria[i])
+
+		negate := strings.HasPrefix(criterion, "!")
+		criterion = strings.TrimPrefix(criterion, "!")
+
+		var ok bool
+
+		switch criterion {
+		case "all":
+			ok = true
+		case "canonical", "final":
+			// sup doesn't canonicalize host names; treat the only pass as final.
+			ok = criterion == "final"
+		case "host", "originalhost", "user", "localuser":
+			if i+1 >= len(criteria) {
+				return false
+			}
+
+			i++
+
+			patterns := strings.Split(criteria[i], ",")
+
+			switch criterion {
+			case "host":
+				ok = matchList(patterns, s.host)
+			case "originalhost":
+				ok = matchList(patterns, s.originalHost)
+			case "user":
+				ok = matchList(patterns, s.user)
+			case "localuser":
+				ok = matchList(patterns, localUser())
+			}
+		default:
+			return false
+		}
+
+		if ok == negate {
+			return false
+		}
+	}
+
+	return true
+}
+
+// matchList reports whether the name matches any of the patterns
+// and none of the negated ones.
+func matchList(patterns []string, name string) bool {
+	matched := false
+
+	for _, pattern := range patterns {
+		negate := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(pattern, "!")
+
+		ok, _ := path.Match(strings.ToLower(pattern), strings.ToLower(name))
+		if !ok {
+			continue
+		}
+
+		if negate {
+			return false
+		}
+
+		matched = true
+	}
+
+	return matched
+}
+
+// expandTokens expands the %h, %u, %r, %d and %% tokens.
+func expandTokens(value string, state *matchState) string {
+	if !strings.Contains(value, "%") {
+		return value
+	}
+
+	replacer := strings.NewReplacer(
+		"%%", "%",
+		"%h", state.host,
+		"%n", state.originalHost,
+		"%r", state.user,
+		"%u", localUser(),
+		"%d", homeDir(),
+	)
+
+	return replacer.Replace(value)
+}
+
+// expandPath expands the leading "~" to the home directory. Relative
+// paths are relative to ~/.ssh.
+func expandPath(file string) string {
+	switch {
+	case file == "~":
+		return homeDir()
+	case strings.HasPrefix(file, "~/"):
+		return filepath.Join(homeDir(), file[2:])
+	case !filepath.IsAbs(file):
+		return filepath.Join(homeDir(), ".ssh", file)
+	default:
+		return file
+	}
+}
+
+func homeDir() string {
+	home, _ := os.UserHomeDir()
+	return home
+}
+
+func localUser() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+
+	return os.Getenv("USER")
+}
@@ -0,0 +1,328 @@
+package sshconfig
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLookup(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	tests := []struct {
+		name   string
+		config string
+		host   string
+		user   string
+		want   Host
+	}{
+		{
+			name: "first value wins",
+			config: `
+Host web
+  User admin
+Host *
+  User nobody
+  Port 2200
+`,
+			host: "web",
+			want: Host{User: "admin", Port: 2200},
+		},
+		{
+			name: "identity files accumulate",
+			config: `
+Host web
+  IdentityFile /keys/web
+Host *
+  IdentityFile /keys/default
+  IdentityFile none
+`,
+			host: "web",
+			want: Host{IdentityFiles: []string{"/keys/web", "/keys/default"}},
+		},
+		{
+			name: "host patterns",
+			config: `
+Host *.example.com !db.example.com
+  User deploy
+`,
+			host: "api.example.com",
+			want: Host{User: "deploy"},
+		},
+		{
+			name: "negated host pattern",
+			config: `
+Host *.example.com !db.example.com
+  User deploy
+`,
+			host: "db.example.com",
+			want: Host{},
+		},
+		{
+			name: "keywords are case insensitive",
+			config: `
+HOST web
+  hostname=10.0.0.1
+  PORT "2222"
+`,
+			host: "web",
+			want: Host{HostName: "10.0.0.1", Port: 2222},
+		},
+		{
+			name: "options before first host apply to all",
+			config: `
+Port 2200
+Host web
+  IdentitiesOnly yes
+`,
+			host: "web",
+			want: Host{Port: 2200, IdentitiesOnly: true},
+		},
+		{
+			name: "match host sees preceding hostname",
+			config: `
+Host web
+  HostName web.internal
+Match host *.internal
+  User deploy
+`,
+			host: "web",
+			want: Host{HostName: "web.internal", User: "deploy"},
+		},
+		{
+			name: "match originalhost",
+			config: `
+Host web
+  HostName web.internal
+Match originalhost web
+  Port 2200
+Match originalhost web.internal
+  User nobody
+`,
+			host: "web",
+			want: Host{HostName: "web.internal", Port: 2200},
+		},
+		{
+			name: "match user",
+			config: `
+Match user deploy,ci
+  IdentityFile /keys/deploy
+Match user root
+  IdentityFile /keys/root
+`,
+			host: "web",
+			user: "deploy",
+			want: Host{IdentityFiles: []string{"/keys/deploy"}},
+		},
+		{
+			name: "match user set by the config",
+			config: `
+Host web
+  User deploy
+Match user deploy
+  Port 2200
+`,
+			host: "web",
+			user: "root",
+			want: Host{User: "deploy", Port: 2200},
+		},
+		{
+			name: "match negated criteria",
+			config: `
+Match !host db
+  User deploy
+`,
+			host: "web",
+			want: Host{User: "deploy"},
+		},
+		{
+			name: "match all and final",
+			config: `
+Match all
+  Port 2200
+Match final
+  User deploy
+Match canonical
+  IdentitiesOnly yes
+`,
+			host: "web",
+			want: Host{Port: 2200, User: "deploy"},
+		},
+		{
+			name: "unsupported match criteria",
+			config: `
+Match exec "true"
+  User deploy
+`,
+			host: "web",
+			want: Host{},
+		},
+		{
+			name: "token expansion",
+			config: `
+Host web
+  HostName %h.example.com
+  IdentityFile ~/.ssh/%r@%n
+  IdentityFile %d/keys/%h_100%%
+`,
+			host: "web",
+			user: "deploy",
+			want: Host{
+				HostName: "web.example.com",
+				IdentityFiles: []string{
+					filepath.Join(home, ".ssh", "deploy@web"),
+					filepath.Join(home, "keys", "web.example.com_100%"),
+				},
+			},
+		},
+		{
+			name: "relative identity file",
+			config: `
+IdentityFile id_deploy
+`,
+			host: "web",
+			want: Host{IdentityFiles: []string{filepath.Join(home, ".ssh", "id_deploy")}},
+		},
+		{
+			name: "forward agent",
+			config: `
+Host web
+  ForwardAgent yes
+Host *
+  ForwardAgent no
+`,
+			host: "web",
+			want: Host{ForwardAgent: true},
+		},
+		{
+			name: "proxy jump",
+			config: `
+Host web
+  ProxyJump bastion1, bastion2
+`,
+			host: "web",
+			want: Host{ProxyJump: []string{"bastion1", "bastion2"}},
+		},
+		{
+			name: "proxy jump none",
+			config: `
+Host web
+  ProxyJump none
+Host *
+  ProxyJump bastion
+`,
+			host: "web",
+			want: Host{ProxyJump: []string{}},
+		},
+		{
+			name: "timeouts",
+			config: `
+Host *
+  ServerAliveInterval 15
+  ServerAliveCountMax 5
+  ConnectTimeout 10
+  ConnectionAttempts 3
+`,
+			host: "web",
+			want: Host{
+				ServerAliveInterval: 15 * time.Second,
+				ServerAliveCountMax: 5,
+				ConnectTimeout:      10 * time.Second,
+				ConnectionAttempts:  3,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := Parse(strings.NewReader(tt.config))
+			require.NoError(t, err)
+			require.Equal(t, tt.want, config.Lookup(tt.host, tt.user))
+		})
+	}
+}
+
+func TestLookupNilConfig(t *testing.T) {
+	var config *Config
+
+	require.Equal(t, Host{}, config.Lookup("web", "root"))
+}
+
+func TestInclude(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	dir := filepath.Join(home, ".ssh")
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "config.d"), 0o755))
+
+	files := map[string]string{
+		"config": `
+Host web
+  Include config.d/*.conf
+  Port 2200
+Host *
+  User nobody
+  Include ` + filepath.Join(dir, "common") + `
+`,
+		// Included within the Host web block, applies to web only.
+		"config.d/web.conf": `
+User deploy
+Host *
+  IdentityFile /keys/web
+`,
+		"common": `
+IdentitiesOnly yes
+`,
+	}
+
+	for name, content := range files {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644))
+	}
+
+	config, err := Load(filepath.Join(dir, "config"))
+	require.NoError(t, err)
+
+	require.Equal(t, Host{
+		User:           "deploy",
+		Port:           2200,
+		IdentityFiles:  []string{"/keys/web"},
+		IdentitiesOnly: true,
+	}, config.Lookup("web", ""))
+
+	require.Equal(t, Host{
+		User:           "nobody",
+		IdentitiesOnly: true,
+	}, config.Lookup("db", ""))
+}
+
+func TestIncludeRecursion(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config")
+	require.NoError(t, os.WriteFile(file, []byte("Include "+file+"\n"), 0o644))
+
+	_, err := Load(file)
+	require.ErrorContains(t, err, "too many nested includes")
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		err    string
+	}{
+		{name: "host without pattern", config: "Host\n", err: "ssh_config:1: Host requires at least one pattern"},
+		{name: "match without criteria", config: "\nMatch\n", err: "ssh_config:2: Match requires criteria"},
+		{name: "unterminated quote", config: `IdentityFile "/keys/web`, err: "unterminated quote"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse(strings.NewReader(tt.config))
+			require.ErrorContains(t, err, tt.err)
+		})
+	}
+}